@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"github.com/morzik45/go-queue/internal/configs"
 	"github.com/morzik45/go-queue/internal/db"
+	"github.com/morzik45/go-queue/internal/push"
 	"github.com/morzik45/go-queue/internal/server"
+	"github.com/morzik45/go-queue/internal/tracing"
 	"io"
 	"log"
 	"net"
@@ -15,25 +17,65 @@ import (
 	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 )
 
 func run(ctx context.Context, _ io.Writer, _ []string) error {
-	config := configs.GetConfig(ctx)
+	// appCtx живёт дольше ctx: соединение с базой и фоновые задачи нужны,
+	// пока http сервер дообрабатывает запросы после получения сигнала
+	appCtx, stopApp := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopApp()
 
-	store, err := db.NewMongoDB(ctx, config.Sub("mongodb"))
+	config := configs.GetConfig(appCtx)
+
+	shutdownTracing, err := tracing.Init(appCtx, config.Sub("tracing"))
+	if err != nil {
+		return err
+	}
+
+	store, err := db.NewMongoDB(appCtx, config.Sub("mongodb"))
+	if err != nil {
+		return err
+	}
+	store.Configure(config)
+	configs.OnChange(store.Configure)
+
+	srv, err := server.NewServer(appCtx, config, store)
 	if err != nil {
 		return err
 	}
-	srv := server.NewServer(ctx, config, store)
+
+	depthInterval := 15 * time.Second
+	if config.IsSet("metrics.depth_interval") {
+		depthInterval = config.GetDuration("metrics.depth_interval")
+	}
+	go store.SampleDepth(appCtx, depthInterval)
+
+	// задачи очередей с настроенным push.url и события для подписчиков отправляются сервером
+	pusher := push.New(store)
+	go pusher.Run(appCtx)
 
 	httpServer := &http.Server{
 		Addr:    net.JoinHostPort(config.GetString("web.host"), strconv.Itoa(config.GetInt("web.port"))),
 		Handler: srv,
 	}
 
+	httpServer.TLSConfig, err = server.NewTLSConfig(appCtx, config.Sub("web.tls"))
+	if err != nil {
+		return err
+	}
+
 	go func() {
 		log.Printf("listening on %s\n", httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if httpServer.TLSConfig != nil {
+			// сертификаты отдаёт TLSConfig, чтобы их можно было перечитывать на лету
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			_, _ = fmt.Fprintf(os.Stderr, "error listening and serving: %s\n", err)
 		}
 	}()
@@ -43,13 +85,36 @@ func run(ctx context.Context, _ io.Writer, _ []string) error {
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
-		if err = httpServer.Shutdown(ctx); err != nil {
+
+		gracePeriod := 30 * time.Second
+		if config.IsSet("web.shutdown_timeout") {
+			gracePeriod = config.GetDuration("web.shutdown_timeout")
+		}
+
+		// Перестаём выдавать задачи: ожидающие long polling запросы сразу получают "нет задач",
+		// новые получают 503
+		store.Waiters.Drain()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
 			_, _ = fmt.Fprintf(os.Stderr, "error shutting down http server: %s\n", err)
+			_ = httpServer.Close()
 		}
-		err = store.Close()
-		if err != nil {
+
+		// Запросов больше нет, останавливаем фоновые задачи и ждём горутину раздачи задач
+		stopApp()
+		<-store.Waiters.Done()
+		<-pusher.Done()
+
+		if err := store.Close(); err != nil {
 			_, _ = fmt.Fprintf(os.Stderr, "error closing db: %s\n", err)
 		}
+		tracingCtx, cancelTracing := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelTracing()
+		if err := shutdownTracing(tracingCtx); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error shutting down tracing: %s\n", err)
+		}
 	}()
 
 	wg.Wait()
@@ -59,7 +124,7 @@ func run(ctx context.Context, _ io.Writer, _ []string) error {
 func main() {
 	var ctx context.Context
 	ctx = context.Background()
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	if err := run(ctx, os.Stdout, os.Args); err != nil {
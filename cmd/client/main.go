@@ -8,6 +8,7 @@ import (
 	"github.com/morzik45/go-queue/internal/server/handlers"
 	"io"
 	"net/http"
+	"os"
 )
 
 func main() {
@@ -41,6 +42,7 @@ func enqueue() {
 	if err != nil {
 		panic(err)
 	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("GO_QUEUE_API_KEY"))
 
 	client := &http.Client{}
 	var resp *http.Response
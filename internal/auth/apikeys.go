@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// KeyFinder ищет ключ по его хешу во внешнем хранилище. Если ключ не найден, возвращает nil, nil.
+type KeyFinder interface {
+	FindAPIKey(ctx context.Context, hash string) (*Identity, error)
+}
+
+type keyConfig struct {
+	Name      string   `mapstructure:"name"`
+	Key       string   `mapstructure:"key"`
+	Scopes    []Scope  `mapstructure:"scopes"`
+	Queues    []string `mapstructure:"queues"`
+	Namespace string   `mapstructure:"namespace"`
+}
+
+// APIKeys аутентифицирует клиентов по ключу из заголовка Authorization: Bearer.
+// Ключи берутся из auth.api_keys в конфиге, а если там ключа нет - из KeyFinder.
+type APIKeys struct {
+	keys   atomic.Pointer[map[string]*Identity]
+	finder KeyFinder
+}
+
+func NewAPIKeys(cfg *viper.Viper, finder KeyFinder) *APIKeys {
+	a := &APIKeys{finder: finder}
+	a.Reload(cfg)
+	return a
+}
+
+// Reload перечитывает ключи из конфига
+func (a *APIKeys) Reload(cfg *viper.Viper) {
+	keys := make(map[string]*Identity)
+
+	// Старый единственный ключ из корня конфига даёт полный доступ
+	if legacy := cfg.GetString("api_key"); legacy != "" {
+		keys[HashKey(legacy)] = &Identity{Name: "default", Scopes: []Scope{ScopeAdmin}}
+	}
+
+	var configured []keyConfig
+	if err := cfg.UnmarshalKey("auth.api_keys", &configured); err != nil {
+		slog.Error("failed to read api keys from config", slog.Any("error", err))
+		return
+	}
+	for i, k := range configured {
+		if k.Key == "" {
+			slog.Warn("api key without key is ignored", slog.Int("index", i), slog.String("name", k.Name))
+			continue
+		}
+		keys[HashKey(k.Key)] = &Identity{Name: k.Name, Scopes: k.Scopes, Queues: k.Queues, Namespace: k.Namespace}
+	}
+
+	a.keys.Store(&keys)
+	slog.Info("api keys loaded", slog.Int("count", len(keys)))
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	key := BearerToken(r)
+	if key == "" {
+		key = legacyKey(r.Context())
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	hash := HashKey(key)
+	if identity, ok := (*a.keys.Load())[hash]; ok {
+		return identity, nil
+	}
+
+	if a.finder != nil {
+		identity, err := a.finder.FindAPIKey(r.Context(), hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find api key: %w", err)
+		}
+		if identity != nil {
+			return identity, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// HashKey возвращает sha256 ключа в hex. В коллекции api_keys ключи хранятся только в таком виде.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNoCredentials запрос не содержит данных, которые понимает аутентификатор
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials данные для аутентификации есть, но они неверны
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator определяет клиента по http запросу
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain пробует аутентификаторы по очереди, пока один из них не узнает данные запроса
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		identity, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// BearerToken извлекает токен из заголовка Authorization
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+const legacyKeyKey contextKey = "auth_legacy_api_key"
+
+// WithLegacyKey сохраняет api_key, переданный по-старому в теле запроса
+func WithLegacyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, legacyKeyKey, key)
+}
+
+func legacyKey(ctx context.Context) string {
+	key, _ := ctx.Value(legacyKeyKey).(string)
+	return key
+}
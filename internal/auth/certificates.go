@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/x509"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+)
+
+type certIdentityConfig struct {
+	Name      string   `mapstructure:"name"`
+	Subject   string   `mapstructure:"subject"`
+	SAN       string   `mapstructure:"san"`
+	Scopes    []Scope  `mapstructure:"scopes"`
+	Queues    []string `mapstructure:"queues"`
+	Namespace string   `mapstructure:"namespace"`
+}
+
+// Certificates аутентифицирует клиентов по проверенному клиентскому сертификату (mTLS).
+// Сертификат сопоставляется с auth.mtls.identities по subject (CN или полный DN)
+// или по SAN (DNS, URI или email).
+type Certificates struct {
+	identities atomic.Pointer[[]certIdentityConfig]
+}
+
+func NewCertificates(cfg *viper.Viper) *Certificates {
+	c := &Certificates{}
+	c.Reload(cfg)
+	return c
+}
+
+// Reload перечитывает сопоставления сертификатов из конфига
+func (c *Certificates) Reload(cfg *viper.Viper) {
+	var identities []certIdentityConfig
+	if err := cfg.UnmarshalKey("auth.mtls.identities", &identities); err != nil {
+		slog.Error("failed to read mtls identities from config", slog.Any("error", err))
+		return
+	}
+	c.identities.Store(&identities)
+}
+
+func (c *Certificates) Authenticate(r *http.Request) (*Identity, error) {
+	// Учитываем только сертификаты, прошедшие проверку по client_ca_file
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	for _, ic := range *c.identities.Load() {
+		if certMatches(cert, ic) {
+			return &Identity{Name: ic.Name, Scopes: ic.Scopes, Queues: ic.Queues, Namespace: ic.Namespace}, nil
+		}
+	}
+	// Сертификат валиден, но не сопоставлен - пусть клиента определят по другим данным
+	return nil, ErrNoCredentials
+}
+
+func certMatches(cert *x509.Certificate, ic certIdentityConfig) bool {
+	if ic.Subject != "" && (ic.Subject == cert.Subject.CommonName || ic.Subject == cert.Subject.String()) {
+		return true
+	}
+	if ic.SAN == "" {
+		return false
+	}
+	if slices.Contains(cert.DNSNames, ic.SAN) || slices.Contains(cert.EmailAddresses, ic.SAN) {
+		return true
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == ic.SAN {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"path"
+	"slices"
+)
+
+// DefaultNamespace пространство имён для задач и клиентов, у которых оно не задано
+const DefaultNamespace = "default"
+
+// Scope операция, которую разрешено выполнять
+type Scope string
+
+const (
+	ScopeEnqueue Scope = "enqueue"
+	ScopeDequeue Scope = "dequeue"
+	ScopeAck     Scope = "ack"
+	ScopeAdmin   Scope = "admin" // разрешает всё
+)
+
+// Identity аутентифицированный клиент и его права
+type Identity struct {
+	Name   string
+	Scopes []Scope
+	// Queues шаблоны (path.Match) типов очередей, с которыми разрешено работать. Пустой список - все очереди.
+	Queues []string
+	// Namespace пространство имён (тенант), к которому привязан клиент. Пустое - доступны все.
+	Namespace string
+
+	// noQueues клиенту не разрешена ни одна очередь (JWT без клейма с очередями)
+	noQueues bool
+}
+
+// HasScope проверяет, что клиенту разрешена операция
+func (i *Identity) HasScope(scope Scope) bool {
+	return slices.Contains(i.Scopes, ScopeAdmin) || slices.Contains(i.Scopes, scope)
+}
+
+// CanAccessQueue проверяет, что клиенту разрешено работать с типом очереди
+func (i *Identity) CanAccessQueue(qType string) bool {
+	if i.noQueues {
+		return false
+	}
+	if len(i.Queues) == 0 {
+		return true
+	}
+	for _, pattern := range i.Queues {
+		if ok, _ := path.Match(pattern, qType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessNamespace проверяет, что клиенту разрешено работать с пространством имён
+func (i *Identity) CanAccessNamespace(namespace string) bool {
+	return i.Namespace == "" || i.Namespace == namespace
+}
+
+type contextKey string
+
+const (
+	identityKey  contextKey = "auth_identity"
+	namespaceKey contextKey = "auth_namespace"
+)
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
+// FromContext возвращает клиента, аутентифицированного для текущего запроса
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(*Identity)
+	return identity, ok && identity != nil
+}
+
+// WithNamespace сохраняет пространство имён, в котором выполняется запрос
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey, namespace)
+}
+
+// Namespace возвращает пространство имён, в котором выполняется запрос
+func Namespace(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceKey).(string)
+	return namespace
+}
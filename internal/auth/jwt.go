@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type jwtState struct {
+	keys           map[string]interface{} // kid -> ключ проверки подписи
+	parser         *jwt.Parser
+	scopesClaim    string
+	queuesClaim    string
+	namespaceClaim string
+}
+
+// JWT аутентифицирует клиентов по JWT из заголовка Authorization: Bearer.
+// Операции и разрешённые очереди берутся из клеймов токена.
+//
+// Настройки (auth.jwt):
+//   - algorithms: разрешённые алгоритмы (по умолчанию HS256, RS256, ES256)
+//   - secret: общий секрет для HS256
+//   - public_key_file: PEM с публичным ключом RSA или EC
+//   - jwks_file: локальный JWKS файл, ключ выбирается по kid
+//   - issuer, audience: ожидаемые iss и aud
+//   - scopes_claim, queues_claim, namespace_claim: имена клеймов с операциями, шаблонами очередей
+//     и пространством имён (scope, queues и namespace)
+//
+// Токен без клейма с очередями не даёт доступа ни к одной очереди, все очереди разрешает шаблон "*".
+// Токен без клейма с пространством имён работает в пространстве DefaultNamespace.
+type JWT struct {
+	state atomic.Pointer[jwtState]
+}
+
+func NewJWT(cfg *viper.Viper) (*JWT, error) {
+	state, err := newJWTState(cfg)
+	if err != nil {
+		return nil, err
+	}
+	j := &JWT{}
+	j.state.Store(state)
+	return j, nil
+}
+
+// Reload перечитывает настройки и ключи. При ошибке продолжают использоваться старые.
+func (j *JWT) Reload(cfg *viper.Viper) {
+	state, err := newJWTState(cfg)
+	if err != nil {
+		slog.Error("failed to reload jwt keys, keeping previous", slog.Any("error", err))
+		return
+	}
+	j.state.Store(state)
+	slog.Info("jwt keys reloaded", slog.Int("count", len(state.keys)))
+}
+
+func newJWTState(cfg *viper.Viper) (*jwtState, error) {
+	state := &jwtState{
+		keys:           make(map[string]interface{}),
+		scopesClaim:    "scope",
+		queuesClaim:    "queues",
+		namespaceClaim: "namespace",
+	}
+	if cfg == nil {
+		return nil, errors.New("missing auth.jwt configuration")
+	}
+	if cfg.IsSet("scopes_claim") {
+		state.scopesClaim = cfg.GetString("scopes_claim")
+	}
+	if cfg.IsSet("queues_claim") {
+		state.queuesClaim = cfg.GetString("queues_claim")
+	}
+	if cfg.IsSet("namespace_claim") {
+		state.namespaceClaim = cfg.GetString("namespace_claim")
+	}
+
+	if secret := cfg.GetString("secret"); secret != "" {
+		state.keys[""] = []byte(secret)
+	}
+	if path := cfg.GetString("public_key_file"); path != "" {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		state.keys[""] = key
+	}
+	if path := cfg.GetString("jwks_file"); path != "" {
+		keys, err := loadJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		for kid, key := range keys {
+			state.keys[kid] = key
+		}
+	}
+	if len(state.keys) == 0 {
+		return nil, errors.New("no jwt keys configured: set secret, public_key_file or jwks_file")
+	}
+
+	algorithms := []string{"HS256", "RS256", "ES256"}
+	if cfg.IsSet("algorithms") {
+		algorithms = cfg.GetStringSlice("algorithms")
+	}
+	opts := []jwt.ParserOption{jwt.WithValidMethods(algorithms), jwt.WithExpirationRequired()}
+	if iss := cfg.GetString("issuer"); iss != "" {
+		opts = append(opts, jwt.WithIssuer(iss))
+	}
+	if aud := cfg.GetString("audience"); aud != "" {
+		opts = append(opts, jwt.WithAudience(aud))
+	}
+	state.parser = jwt.NewParser(opts...)
+
+	return state, nil
+}
+
+func loadPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("public key %s is neither RSA nor EC PEM", path)
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	token := BearerToken(r)
+	// Не JWT - пусть разбирается следующий аутентификатор
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	state := j.state.Load()
+	claims := jwt.MapClaims{}
+	_, err := state.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := state.keys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	})
+	if err != nil {
+		slog.DebugContext(r.Context(), "jwt rejected", slog.Any("error", err))
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	subject, _ := claims.GetSubject()
+	namespace, _ := claims[state.namespaceClaim].(string)
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	identity := &Identity{
+		Name:      subject,
+		Queues:    claimStrings(claims[state.queuesClaim]),
+		Namespace: namespace,
+	}
+	identity.noQueues = len(identity.Queues) == 0
+	for _, s := range claimStrings(claims[state.scopesClaim]) {
+		identity.Scopes = append(identity.Scopes, Scope(s))
+	}
+	return identity, nil
+}
+
+// claimStrings разбирает клейм, заданный строкой через пробел (как scope в OAuth 2.0) или массивом строк
+func claimStrings(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		result := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
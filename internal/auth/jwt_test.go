@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClaimStrings(t *testing.T) {
+	tests := []struct {
+		name  string
+		claim interface{}
+		want  []string
+	}{
+		{name: "space separated", claim: "enqueue  dequeue ack", want: []string{"enqueue", "dequeue", "ack"}},
+		{name: "array", claim: []interface{}{"emails", "reports.*"}, want: []string{"emails", "reports.*"}},
+		{name: "array with non strings", claim: []interface{}{"emails", 42, true}, want: []string{"emails"}},
+		{name: "empty string", claim: "", want: []string{}},
+		{name: "missing", claim: nil, want: nil},
+		{name: "number", claim: 42.0, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := claimStrings(tt.claim)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("claimStrings(%v) = %q, want %q", tt.claim, got, tt.want)
+			}
+		})
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaJWK := map[string]string{
+		"kty": "RSA", "kid": "rsa", "use": "sig",
+		"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}
+	ecJWK := map[string]string{
+		"kty": "EC", "kid": "ec", "crv": "P-256",
+		"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes()),
+	}
+	octJWK := map[string]string{"kty": "oct", "kid": "hmac", "k": b64([]byte("secret"))}
+	encJWK := map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": rsaJWK["n"], "e": rsaJWK["e"]}
+
+	tests := []struct {
+		name    string
+		keys    []map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "all key types", keys: []map[string]string{rsaJWK, ecJWK, octJWK}, want: []string{"ec", "hmac", "rsa"}},
+		{name: "encryption keys are skipped", keys: []map[string]string{rsaJWK, encJWK}, want: []string{"rsa"}},
+		{name: "unsupported curve", keys: []map[string]string{{"kty": "EC", "kid": "x", "crv": "P-192"}}, wantErr: true},
+		{name: "unsupported key type", keys: []map[string]string{{"kty": "OKP", "kid": "x"}}, wantErr: true},
+		{name: "bad encoding", keys: []map[string]string{{"kty": "RSA", "kid": "x", "n": "!!", "e": "AQAB"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := loadJWKS(writeJWKS(t, tt.keys...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadJWKS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got []string
+			for kid := range keys {
+				got = append(got, kid)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("loadJWKS() kids = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	keys, err := loadJWKS(writeJWKS(t, rsaJWK, ecJWK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := keys["rsa"].(*rsa.PublicKey); !ok || !got.Equal(&rsaKey.PublicKey) {
+		t.Errorf("rsa key = %v, want %v", keys["rsa"], &rsaKey.PublicKey)
+	}
+	if got, ok := keys["ec"].(*ecdsa.PublicKey); !ok || !got.Equal(&ecKey.PublicKey) {
+		t.Errorf("ec key = %v, want %v", keys["ec"], &ecKey.PublicKey)
+	}
+
+	if _, err = loadJWKS(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadJWKS() of missing file: expected error")
+	}
+}
+
+func TestJWTAuthenticateClaims(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("secret", "secret")
+	j, err := NewJWT(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		claims        jwt.MapClaims
+		wantNamespace string
+		allowed       []string
+		denied        []string
+	}{
+		{
+			name:          "explicit claims",
+			claims:        jwt.MapClaims{"namespace": "acme", "queues": []string{"emails", "reports.*"}},
+			wantNamespace: "acme",
+			allowed:       []string{"emails", "reports.daily"},
+			denied:        []string{"billing"},
+		},
+		{
+			name:          "missing namespace uses default",
+			claims:        jwt.MapClaims{"queues": "*"},
+			wantNamespace: DefaultNamespace,
+			allowed:       []string{"emails", "billing"},
+		},
+		{
+			name:          "missing queues denies all",
+			claims:        jwt.MapClaims{"namespace": "acme"},
+			wantNamespace: "acme",
+			denied:        []string{"emails", "billing"},
+		},
+		{
+			name:          "empty queues denies all",
+			claims:        jwt.MapClaims{"queues": []string{}},
+			wantNamespace: DefaultNamespace,
+			denied:        []string{"emails"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"sub": "worker", "scope": "dequeue ack", "exp": time.Now().Add(time.Minute).Unix()}
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+
+			identity, err := j.Authenticate(r)
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if identity.Namespace != tt.wantNamespace {
+				t.Errorf("Namespace = %q, want %q", identity.Namespace, tt.wantNamespace)
+			}
+			if identity.CanAccessNamespace("other") {
+				t.Error("CanAccessNamespace(other) = true, want false")
+			}
+			for _, qType := range tt.allowed {
+				if !identity.CanAccessQueue(qType) {
+					t.Errorf("CanAccessQueue(%q) = false, want true", qType)
+				}
+			}
+			for _, qType := range tt.denied {
+				if identity.CanAccessQueue(qType) {
+					t.Errorf("CanAccessQueue(%q) = true, want false", qType)
+				}
+			}
+		})
+	}
+}
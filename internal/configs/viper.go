@@ -6,8 +6,21 @@ import (
 	"github.com/morzik45/go-queue/internal/logs"
 	"github.com/spf13/viper"
 	"log/slog"
+	"sync"
 )
 
+var (
+	listenersMu sync.Mutex
+	listeners   []func(v *viper.Viper)
+)
+
+// OnChange регистрирует функцию, которая будет вызвана после перечитывания файла конфигурации
+func OnChange(fn func(v *viper.Viper)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = append(listeners, fn)
+}
+
 func GetConfig(ctx context.Context) *viper.Viper {
 	v := viper.New()
 	v.SetConfigName("config")
@@ -25,6 +38,12 @@ func GetConfig(ctx context.Context) *viper.Viper {
 	v.OnConfigChange(func(e fsnotify.Event) {
 		slog.Info("Config file changed:", slog.String("path", e.Name))
 		logs.SetLevel(v.GetString("logging.level"))
+
+		listenersMu.Lock()
+		defer listenersMu.Unlock()
+		for _, fn := range listeners {
+			fn(v)
+		}
 	})
 	v.WatchConfig()
 
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"log/slog"
+	"time"
+)
+
+// agingCheckInterval как часто пересчитывается эффективный приоритет ожидающих задач
+const agingCheckInterval = 15 * time.Second
+
+// AgingConfig политика старения: каждые Every ожидания эффективный приоритет задачи растёт на Step,
+// но не выше Max (0 - без ограничения)
+type AgingConfig struct {
+	Every time.Duration `mapstructure:"every"`
+	Step  int           `mapstructure:"step"`
+	Max   int           `mapstructure:"max"`
+}
+
+func (a AgingConfig) enabled() bool {
+	return a.Every > 0 && a.Step > 0
+}
+
+// agePriorities периодически поднимает эффективный приоритет долго ожидающих задач
+func (m *DB) agePriorities(ctx context.Context) {
+	ticker := time.NewTicker(agingCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.age(ctx); err != nil {
+				slog.ErrorContext(ctx, "failed to age task priorities", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// age пересчитывает эффективный приоритет задач всех типов, для которых настроено старение, и возвращает
+// обычный приоритет задачам типов, у которых старение выключили.
+// Значение вычисляется из времени ожидания, поэтому пересчёт с нескольких инстансов безопасен.
+func (m *DB) age(ctx context.Context) error {
+	s := m.config()
+
+	// Типы в конфиге без учёта регистра, поэтому сопоставляем с реальными типами ожидающих задач
+	var qTypes []string
+	if err := m.queue.Distinct(ctx, "Type", bson.M{"Statuses.0.Status": "Enqueued"}).Decode(&qTypes); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	aged := bson.A{}
+	for _, qType := range qTypes {
+		aging := s.typeConfig(qType).Aging
+		if !aging.enabled() {
+			continue
+		}
+		aged = append(aged, qType)
+
+		filter := bson.M{
+			"Type":              qType,
+			"Statuses.0.Status": "Enqueued",
+			// задачи моложе одного шага ещё не постарели
+			"Statuses.0.Timestamp": bson.M{"$lte": now.Add(-aging.Every)},
+		}
+		waited := bson.M{"$subtract": bson.A{now, bson.M{"$arrayElemAt": bson.A{"$Statuses.Timestamp", 0}}}}
+		var priority interface{} = bson.M{"$add": bson.A{
+			"$Priority",
+			bson.M{"$multiply": bson.A{
+				aging.Step,
+				bson.M{"$toInt": bson.M{"$floor": bson.M{"$divide": bson.A{waited, aging.Every.Milliseconds()}}}},
+			}},
+		}}
+		if aging.Max > 0 {
+			filter["EffectivePriority"] = bson.M{"$lt": aging.Max}
+			priority = bson.M{"$min": bson.A{priority, aging.Max}}
+		}
+		update := bson.A{
+			bson.M{"$set": bson.M{"EffectivePriority": bson.M{"$max": bson.A{"$Priority", priority}}}},
+		}
+
+		res, err := m.queue.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount > 0 {
+			slog.DebugContext(ctx, "aged task priorities", slog.String("queue_type", qType), slog.Int64("count", res.ModifiedCount))
+		}
+	}
+
+	// У типов без старения накопленная прибавка к приоритету сбрасывается
+	res, err := m.queue.UpdateMany(ctx,
+		bson.M{
+			"Type":              bson.M{"$nin": aged},
+			"Statuses.0.Status": "Enqueued",
+			"$expr":             bson.M{"$ne": bson.A{"$EffectivePriority", "$Priority"}},
+		},
+		bson.A{bson.M{"$set": bson.M{"EffectivePriority": "$Priority"}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		slog.DebugContext(ctx, "reset aged task priorities", slog.Int64("count", res.ModifiedCount))
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/morzik45/go-queue/internal/auth"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// APIKey ключ доступа в коллекции api_keys. Сам ключ не хранится, только его sha256 (см. auth.HashKey).
+type APIKey struct {
+	KeyHash   string       `bson:"KeyHash"`
+	Name      string       `bson:"Name"`
+	Scopes    []auth.Scope `bson:"Scopes"`
+	Queues    []string     `bson:"Queues,omitempty"`
+	Namespace string       `bson:"Namespace,omitempty"`
+	Disabled  bool         `bson:"Disabled,omitempty"`
+}
+
+// FindAPIKey ищет активный ключ по его хешу
+func (m *DB) FindAPIKey(ctx context.Context, hash string) (_ *auth.Identity, err error) {
+	ctx, span := startSpan(ctx, "api_keys", "find")
+	defer func() { endSpan(span, err) }()
+
+	var key APIKey
+	err = m.apiKeys.FindOne(ctx, bson.M{"KeyHash": hash, "Disabled": bson.M{"$ne": true}}).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.Identity{Name: key.Name, Scopes: key.Scopes, Queues: key.Queues, Namespace: key.Namespace}, nil
+}
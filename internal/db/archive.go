@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"time"
+)
+
+const (
+	// archiveInterval как часто завершённые задачи переносятся в архив, если их не перенесли сразу
+	archiveInterval = 5 * time.Second
+	// archiveBatchSize сколько задач переносится за один проход
+	archiveBatchSize = 500
+)
+
+// archiveConfig перенос завершённых задач из queue в queue_history
+type archiveConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Retention сколько хранить задачи в архиве; если не задано - как в очереди
+	Retention RetentionConfig `mapstructure:"retention"`
+}
+
+// archiveRetention срок хранения архивной задачи типа qType в статусе status. Отрицательный - хранить бессрочно.
+func (s *settings) archiveRetention(qType, status string) time.Duration {
+	if d := s.Queue.Archive.Retention.forStatus(status); d != 0 {
+		return d
+	}
+	return s.retention(qType, status)
+}
+
+// archiveSoon просит архиватор не дожидаться следующего прохода
+func (m *DB) archiveSoon() {
+	select {
+	case m.archiveNow <- struct{}{}:
+	default:
+	}
+}
+
+// archive переносит завершённые задачи в архив, пока не отменён контекст
+func (m *DB) archive(ctx context.Context) {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.archiveNow:
+		}
+		if !m.config().Queue.Archive.Enabled {
+			continue
+		}
+		if err := m.archiveTerminal(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to archive tasks", slog.Any("error", err))
+		}
+	}
+}
+
+// archiveTerminal переносит все завершённые задачи в архив. Задача сначала копируется, а потом удаляется
+// из очереди, поэтому при сбое между шагами она останется в обеих коллекциях и будет удалена следующим проходом.
+func (m *DB) archiveTerminal(ctx context.Context) error {
+	filter := bson.M{"Statuses.0.Status": bson.M{"$in": terminalStatuses}}
+	for {
+		cursor, err := m.queue.Find(ctx, filter, options.Find().SetLimit(archiveBatchSize))
+		if err != nil {
+			return err
+		}
+		var docs []bson.M
+		if err = cursor.All(ctx, &docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+
+		s := m.config()
+		now := time.Now().UTC()
+		ids := make(bson.A, 0, len(docs))
+		archived := make([]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			var task Task
+			raw, err := bson.Marshal(doc)
+			if err == nil {
+				err = bson.Unmarshal(raw, &task)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to decode task %v: %w", doc["_id"], err)
+			}
+
+			doc["ArchivedAt"] = now
+			current := task.Current()
+			if d := s.archiveRetention(task.Type, current.Status); d >= 0 {
+				doc["ExpireAt"] = current.Timestamp.Add(d)
+			} else {
+				delete(doc, "ExpireAt")
+			}
+			ids = append(ids, task.ID)
+			archived = append(archived, doc)
+		}
+
+		_, err = m.history.InsertMany(ctx, archived, options.InsertMany().SetOrdered(false))
+		ids, archiveErr := archivedIDs(ids, err)
+		if len(ids) > 0 {
+			res, err := m.queue.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "Statuses.0.Status": bson.M{"$in": terminalStatuses}})
+			if err != nil {
+				return err
+			}
+			slog.DebugContext(ctx, "archived tasks", slog.Int64("count", res.DeletedCount))
+		}
+		if archiveErr != nil {
+			// не скопированные задачи остаются в очереди до следующего прохода
+			return archiveErr
+		}
+
+		if len(docs) < archiveBatchSize {
+			return nil
+		}
+	}
+}
+
+// archivedIDs оставляет из ids задачи, которые есть в архиве после вставки с ошибкой err: вставленные и
+// уже скопированные прошлым проходом. Если какие-то задачи скопировать не удалось, возвращает и ошибку.
+func archivedIDs(ids bson.A, err error) (bson.A, error) {
+	if err == nil {
+		return ids, nil
+	}
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return nil, err
+	}
+	failed := make(map[int]bool, len(bulkErr.WriteErrors))
+	for _, e := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(e) {
+			failed[e.Index] = true
+		}
+	}
+	if len(failed) == 0 {
+		return ids, nil
+	}
+	archived := make(bson.A, 0, len(ids)-len(failed))
+	for i, id := range ids {
+		if !failed[i] {
+			archived = append(archived, id)
+		}
+	}
+	return archived, fmt.Errorf("failed to archive %d tasks: %w", len(failed), err)
+}
+
+// Task возвращает задачу по идентификатору из очереди или, если её там уже нет, из архива
+func (m *DB) Task(ctx context.Context, namespace, id string) (_ *Task, err error) {
+	ctx, span := startSpan(ctx, "queue", "find")
+	span.SetAttributes(attribute.String("queue.task_id", id))
+	defer func() { endSpan(span, err) }()
+
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrTaskNotFound
+	}
+
+	filter := bson.M{"_id": oID, "Namespace": namespace}
+	for _, coll := range []*mongo.Collection{m.queue, m.history} {
+		var task Task
+		err = coll.FindOne(ctx, filter).Decode(&task)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find task: %w", err)
+		}
+		return &task, nil
+	}
+	return nil, ErrTaskNotFound
+}
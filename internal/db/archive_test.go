@@ -0,0 +1,63 @@
+package db
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"slices"
+	"testing"
+)
+
+func TestArchivedIDs(t *testing.T) {
+	ids := bson.A{"a", "b", "c"}
+	writeErr := func(index, code int) mongo.BulkWriteError {
+		return mongo.BulkWriteError{WriteError: mongo.WriteError{Index: index, Code: code, Message: "error"}}
+	}
+	other := errors.New("connection reset")
+
+	tests := []struct {
+		name    string
+		err     error
+		want    bson.A
+		wantErr bool
+	}{
+		{name: "all inserted", want: ids},
+		{
+			name: "already archived",
+			err:  mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(0, 11000), writeErr(2, 11000)}},
+			want: ids,
+		},
+		{
+			name:    "some failed",
+			err:     mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(0, 11000), writeErr(1, 2)}},
+			want:    bson.A{"a", "c"},
+			wantErr: true,
+		},
+		{
+			name:    "all failed",
+			err:     mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(0, 2), writeErr(1, 2), writeErr(2, 2)}},
+			want:    bson.A{},
+			wantErr: true,
+		},
+		{
+			name: "write concern error",
+			err: mongo.BulkWriteException{
+				WriteConcernError: &mongo.WriteConcernError{Code: 64},
+				WriteErrors:       []mongo.BulkWriteError{writeErr(0, 11000)},
+			},
+			wantErr: true,
+		},
+		{name: "other error", err: other, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := archivedIDs(ids, tt.err)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("archivedIDs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("archivedIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// batchRetention сколько хранится описание группы задач
+const batchRetention = 7 * 24 * time.Hour
+
+// ErrBatchNotFound группы нет в пространстве имён
+var ErrBatchNotFound = errors.New("batch not found")
+
+// BatchParams новая группа задач
+type BatchParams struct {
+	Namespace string
+	Tasks     []EnqueueParams
+	// Chain задачи выполняются по очереди, каждая получает результат предыдущей в Payload.results
+	Chain bool
+	// Callback задача, которая ставится в очередь после успешного выполнения всех задач группы
+	// и получает их результаты в Payload.results
+	Callback *EnqueueParams
+}
+
+// Batch группа задач, добавленных одним запросом
+type Batch struct {
+	ID          bson.ObjectID   `bson:"_id" json:"id"`
+	Namespace   string          `bson:"Namespace" json:"namespace"`
+	Chain       bool            `bson:"Chain,omitempty" json:"chain,omitempty"`
+	Tasks       []bson.ObjectID `bson:"Tasks" json:"tasks"`
+	Types       []string        `bson:"Types" json:"queue_types"`
+	Callback    *bson.ObjectID  `bson:"Callback,omitempty" json:"callback,omitempty"`
+	CreatedAt   time.Time       `bson:"CreatedAt" json:"created_at"`
+	CancelledAt *time.Time      `bson:"CancelledAt,omitempty" json:"cancelled_at,omitempty"`
+
+	Progress *BatchProgress `bson:"-" json:"progress,omitempty"`
+}
+
+// BatchProgress сколько задач группы выполнено, завершилось неудачно и ещё ждёт выполнения
+type BatchProgress struct {
+	Total   int `json:"total"`
+	Done    int `json:"done"`
+	Failed  int `json:"failed"`
+	Pending int `json:"pending"`
+	// CallbackStatus текущий статус задачи обратного вызова
+	CallbackStatus string `json:"callback_status,omitempty"`
+	// Completed все задачи группы, включая обратный вызов, в конечном статусе
+	Completed bool `json:"completed"`
+}
+
+// CreateBatch добавляет группу задач и, если задан, обратный вызов. Если добавить все задачи не удалось,
+// уже добавленные отменяются.
+func (m *DB) CreateBatch(ctx context.Context, p BatchParams) (_ *Batch, err error) {
+	ctx, span := startSpan(ctx, "queue", "batch")
+	span.SetAttributes(attribute.String("queue.namespace", p.Namespace), attribute.Int("queue.batch_size", len(p.Tasks)))
+	defer func() { endSpan(span, err) }()
+
+	batch := &Batch{
+		ID:        bson.NewObjectID(),
+		Namespace: p.Namespace,
+		Chain:     p.Chain,
+		Tasks:     make([]bson.ObjectID, 0, len(p.Tasks)),
+		CreatedAt: time.Now().UTC(),
+	}
+	defer func() {
+		if err != nil {
+			m.cancelBatchTasks(ctx, batch.ID, "batch creation failed")
+		}
+	}()
+
+	enqueue := func(tp EnqueueParams, deps []bson.ObjectID) (bson.ObjectID, error) {
+		tp.Namespace = p.Namespace
+		tp.batchID = batch.ID
+		if len(deps) > 0 {
+			tp.collectResults = true
+			for _, dep := range deps {
+				tp.DependsOn = append(tp.DependsOn, dep.Hex())
+			}
+		}
+		if !slices.Contains(batch.Types, tp.Type) {
+			batch.Types = append(batch.Types, tp.Type)
+		}
+		id, err := m.Enqueue(ctx, tp)
+		if err != nil {
+			return bson.ObjectID{}, err
+		}
+		return bson.ObjectIDFromHex(id)
+	}
+
+	for i, tp := range p.Tasks {
+		var deps []bson.ObjectID
+		if p.Chain && i > 0 {
+			deps = batch.Tasks[i-1 : i]
+		}
+		id, err := enqueue(tp, deps)
+		if err != nil {
+			return nil, err
+		}
+		batch.Tasks = append(batch.Tasks, id)
+	}
+
+	if p.Callback != nil {
+		callback := *p.Callback
+		if callback.Payload == nil {
+			// результаты добавляются в Payload, поэтому он не может быть пустым
+			callback.Payload = map[string]interface{}{}
+		}
+		id, err := enqueue(callback, batch.Tasks)
+		if err != nil {
+			return nil, err
+		}
+		batch.Callback = &id
+	}
+
+	if _, err = m.batches.InsertOne(ctx, batch); err != nil {
+		slog.ErrorContext(ctx, "failed to insert batch", slog.String("id", batch.ID.Hex()), slog.Any("error", err))
+		return nil, fmt.Errorf("failed to create batch: %w", err)
+	}
+	return batch, nil
+}
+
+// Batch возвращает группу задач вместе с ходом её выполнения
+func (m *DB) Batch(ctx context.Context, namespace, id string) (*Batch, error) {
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrBatchNotFound
+	}
+
+	var batch Batch
+	err = m.batches.FindOne(ctx, bson.M{"_id": oID, "Namespace": namespace}).Decode(&batch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find batch: %w", err)
+	}
+
+	if batch.Progress, err = m.batchProgress(ctx, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// batchProgress считает задачи группы по текущим статусам в очереди и архиве
+func (m *DB) batchProgress(ctx context.Context, batch *Batch) (*BatchProgress, error) {
+	ids := batch.Tasks
+	if batch.Callback != nil {
+		ids = append(slices.Clip(ids), *batch.Callback)
+	}
+	statuses, err := m.dependencyStatuses(ctx, batch.Namespace, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &BatchProgress{Total: len(batch.Tasks)}
+	for _, id := range batch.Tasks {
+		switch status := statuses[id]; {
+		case status == "Processed":
+			progress.Done++
+		case IsTerminal(status):
+			progress.Failed++
+		case status == "":
+			// задача уже удалена по сроку хранения, исход неизвестен
+			progress.Failed++
+		default:
+			progress.Pending++
+		}
+	}
+	progress.Completed = progress.Pending == 0
+	if batch.Callback != nil {
+		progress.CallbackStatus = statuses[*batch.Callback]
+		progress.Completed = progress.Completed && (progress.CallbackStatus == "" || IsTerminal(progress.CallbackStatus))
+	}
+	return progress, nil
+}
+
+// CancelBatch отменяет все ещё не выданные обработчикам задачи группы. Задачи, которые уже
+// обрабатываются, завершатся как обычно.
+func (m *DB) CancelBatch(ctx context.Context, namespace, id string) (_ *Batch, err error) {
+	ctx, span := startSpan(ctx, "queue", "cancel_batch")
+	span.SetAttributes(attribute.String("queue.batch_id", id))
+	defer func() { endSpan(span, err) }()
+
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrBatchNotFound
+	}
+	update := bson.M{"$set": bson.M{"CancelledAt": time.Now().UTC()}}
+	err = m.batches.FindOneAndUpdate(ctx, bson.M{"_id": oID, "Namespace": namespace}, update).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel batch: %w", err)
+	}
+
+	m.cancelBatchTasks(ctx, oID, "batch cancelled")
+	return m.Batch(ctx, namespace, id)
+}
+
+// cancelBatchTasks отменяет задачи группы в статусах Blocked и Enqueued. Сначала отменяются заблокированные,
+// чтобы они не попали в очередь недоставленных как зависящие от отменённых.
+func (m *DB) cancelBatchTasks(ctx context.Context, batchID bson.ObjectID, message string) {
+	filter := bson.M{"BatchID": batchID, "Statuses.0.Status": bson.M{"$in": bson.A{"Blocked", "Enqueued"}}}
+	cursor, err := m.queue.Find(ctx, filter, options.Find().SetProjection(bson.M{"Statuses": bson.M{"$slice": 1}, "Type": 1}))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to find batch tasks", slog.String("batch_id", batchID.Hex()), slog.Any("error", err))
+		return
+	}
+	var tasks []Task
+	if err = cursor.All(ctx, &tasks); err != nil {
+		slog.ErrorContext(ctx, "failed to decode batch tasks", slog.String("batch_id", batchID.Hex()), slog.Any("error", err))
+		return
+	}
+	slices.SortStableFunc(tasks, func(a, b Task) int {
+		if a.Current().Status == b.Current().Status {
+			return 0
+		}
+		if a.Current().Status == "Blocked" {
+			return -1
+		}
+		return 1
+	})
+
+	for i := range tasks {
+		if _, err = m.cancel(ctx, &tasks[i], message, "Blocked", "Enqueued"); err != nil {
+			slog.ErrorContext(ctx, "failed to cancel batch task", slog.String("id", tasks[i].ID.Hex()), slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// IsTerminal сообщает, что задача в этом статусе больше не изменится
+func IsTerminal(status string) bool {
+	return slices.Contains(terminalStatuses, status)
+}
+
+// Completions ожидание завершения задач. Завершения на этом инстансе приходят сразу,
+// завершения на других инстансах обнаруживаются периодическим опросом базы.
+type Completions struct {
+	store *DB
+
+	mu      sync.Mutex
+	waiters map[bson.ObjectID][]chan struct{}
+}
+
+func newCompletions(ctx context.Context, store *DB) *Completions {
+	c := &Completions{
+		store:   store,
+		waiters: make(map[bson.ObjectID][]chan struct{}),
+	}
+	go c.watch(ctx)
+	return c
+}
+
+// Wait ждёт, пока задача перейдёт в конечный статус, и возвращает её. Если дождаться не удалось
+// (истёк ctx или сервер останавливается), возвращает nil без ошибки.
+func (c *Completions) Wait(ctx context.Context, namespace, id string) (*Task, error) {
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrTaskNotFound
+	}
+	ch, cancel := c.subscribe(oID)
+	defer cancel()
+
+	for {
+		// Проверяем после подписки, чтобы не пропустить завершение между добавлением задачи и подпиской
+		task, err := c.store.Task(ctx, namespace, id)
+		if err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if IsTerminal(task.Current().Status) {
+			return task, nil
+		}
+
+		select {
+		case <-ch:
+		case <-c.store.Waiters.drain:
+			return nil, nil
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, nil
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Subscribe подписывает на изменения задачи: завершение на любом инстансе, возврат в очередь и ход выполнения на этом.
+// Возвращаемая функция отменяет подписку.
+func (c *Completions) Subscribe(id string) (<-chan struct{}, func(), error) {
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, nil, ErrTaskNotFound
+	}
+	ch, cancel := c.subscribe(oID)
+	return ch, cancel, nil
+}
+
+// SubscribeChan как Subscribe, но уведомления приходят в переданный канал, так одним каналом
+// можно следить за несколькими задачами. Канал должен быть буферизованным.
+func (c *Completions) SubscribeChan(id string, ch chan struct{}) (func(), error) {
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrTaskNotFound
+	}
+	return c.add(oID, ch), nil
+}
+
+func (c *Completions) subscribe(id bson.ObjectID) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	return ch, c.add(id, ch)
+}
+
+func (c *Completions) add(id bson.ObjectID, ch chan struct{}) func() {
+	c.mu.Lock()
+	c.waiters[id] = append(c.waiters[id], ch)
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.waiters[id] = slices.DeleteFunc(c.waiters[id], func(w chan struct{}) bool { return w == ch })
+		if len(c.waiters[id]) == 0 {
+			delete(c.waiters, id)
+		}
+	}
+}
+
+// changed будит всех, кто следит за задачей: она завершилась, вернулась в очередь или сообщила о ходе выполнения
+func (c *Completions) changed(id bson.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.waiters[id] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watch периодически проверяет, не завершились ли ожидаемые задачи на других инстансах
+func (c *Completions) watch(ctx context.Context) {
+	interval := c.store.config().pollInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.poll(ctx); err != nil {
+				slog.ErrorContext(ctx, "failed to poll task completions", slog.Any("error", err))
+			}
+			if i := c.store.config().pollInterval(); i != interval {
+				interval = i
+				ticker.Reset(interval)
+			}
+		}
+	}
+}
+
+func (c *Completions) poll(ctx context.Context) error {
+	c.mu.Lock()
+	ids := make([]bson.ObjectID, 0, len(c.waiters))
+	for id := range c.waiters {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	filters := map[*mongo.Collection]bson.M{
+		c.store.queue:   {"_id": bson.M{"$in": ids}, "Statuses.0.Status": bson.M{"$in": terminalStatuses}},
+		c.store.history: {"_id": bson.M{"$in": ids}},
+	}
+	for coll, filter := range filters {
+		cursor, err := coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		var found []struct {
+			ID bson.ObjectID `bson:"_id"`
+		}
+		if err = cursor.All(ctx, &found); err != nil {
+			return err
+		}
+		for _, t := range found {
+			c.changed(t.ID)
+		}
+	}
+	return nil
+}
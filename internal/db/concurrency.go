@@ -0,0 +1,233 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"math"
+	"slices"
+)
+
+// maxClaimAttempts сколько кандидатов перебирает одна выдача задачи, прежде чем сдаться
+const maxClaimAttempts = 16
+
+// SlotID идентификатор слота конкурентности: тип очереди и, если задан concurrency_key, значение этого ключа.
+// Блокировка группы задач - слот с единственным местом и заполненным Group.
+type SlotID struct {
+	Namespace string `bson:"Namespace"`
+	Type      string `bson:"Type"`
+	Key       string `bson:"Key,omitempty"`
+	Group     string `bson:"Group,omitempty"`
+}
+
+// slot документ коллекции slots. Holders - задачи, которые сейчас занимают слоты.
+type slot struct {
+	ID      SlotID          `bson:"_id"`
+	Holders []bson.ObjectID `bson:"Holders"`
+}
+
+// acquireSlot занимает слот для задачи. Возвращает false, если все слоты заняты.
+// Проверка и захват выполняются одной операцией, поэтому лимит соблюдается между инстансами.
+func (m *DB) acquireSlot(ctx context.Context, id SlotID, taskID bson.ObjectID, limit int) (bool, error) {
+	filter := bson.M{
+		"_id": id,
+		// массив короче limit - значит есть свободный слот
+		fmt.Sprintf("Holders.%d", limit-1): bson.M{"$exists": false},
+	}
+	update := bson.M{"$addToSet": bson.M{"Holders": taskID}}
+	_, err := m.slots.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// документ есть, но фильтр не совпал - слоты заняты
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire concurrency slot: %w", err)
+	}
+	return true, nil
+}
+
+// releaseSlots освобождает слоты задачи и будит ожидающих обработчиков этого типа
+func (m *DB) releaseSlots(ctx context.Context, ids []SlotID, taskID bson.ObjectID) {
+	for _, id := range ids {
+		_, err := m.slots.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$pull": bson.M{"Holders": taskID}})
+		if err != nil {
+			// слот освободит сверка в reapLeases
+			slog.ErrorContext(ctx, "failed to release concurrency slot", slog.Any("slot", id), slog.Any("error", err))
+			continue
+		}
+		m.tryNotify(&NewTask{Namespace: id.Namespace, Type: id.Type, Priority: math.MaxInt})
+	}
+}
+
+// acquireSlots занимает блокировку группы и слот конкурентности кандидата. Если что-то занято,
+// возвращает условие, по которому такие задачи нужно пропускать при поиске следующего кандидата.
+func (m *DB) acquireSlots(ctx context.Context, t *Task, tc QueueTypeConfig) ([]SlotID, bson.D, error) {
+	var slots []SlotID
+	if t.GroupKey != "" {
+		id := SlotID{Namespace: t.Namespace, Type: t.Type, Group: t.GroupKey}
+		ok, err := m.acquireSlot(ctx, id, t.ID, 1)
+		if err != nil || !ok {
+			return nil, bson.D{{Key: "Type", Value: t.Type}, {Key: "GroupKey", Value: t.GroupKey}}, err
+		}
+		slots = append(slots, id)
+	}
+
+	if tc.MaxProcessing > 0 {
+		id := SlotID{Namespace: t.Namespace, Type: t.Type}
+		exclude := bson.D{{Key: "Type", Value: t.Type}}
+		if tc.ConcurrencyKey != "" {
+			value := t.Payload[tc.ConcurrencyKey]
+			id.Key = fmt.Sprint(value)
+			exclude = append(exclude, constructDataFilter(tc.ConcurrencyKey, value))
+		}
+		ok, err := m.acquireSlot(ctx, id, t.ID, tc.MaxProcessing)
+		if err != nil || !ok {
+			m.releaseSlots(context.WithoutCancel(ctx), slots, t.ID)
+			return nil, exclude, err
+		}
+		slots = append(slots, id)
+	}
+	return slots, nil, nil
+}
+
+// groupHead возвращает самую старую незавершённую задачу группы кандидата, если она готова к выдаче.
+// Если голова группы ещё не готова (отложена или ниже запрошенного приоритета), возвращает nil.
+func (m *DB) groupHead(ctx context.Context, p DequeueParams, t *Task) (*Task, error) {
+	var head Task
+	err := m.queue.FindOne(ctx, bson.M{
+		"Namespace":         t.Namespace,
+		"Type":              t.Type,
+		"GroupKey":          t.GroupKey,
+		"Statuses.0.Status": bson.M{"$in": pendingStatuses},
+	}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})).Decode(&head)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// кандидата успели забрать
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if head.ID == t.ID {
+		return t, nil
+	}
+
+	filter := m.dequeueFilter(p, []string{t.Type})
+	filter["_id"] = head.ID
+	err = m.queue.FindOne(ctx, filter).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// claimCandidate выдаёт задачу с учётом настроек её типа: находит кандидата, занимает для него блокировку
+// группы и слот конкурентности и только потом забирает задачу. Если группа, слоты типа или значения ключа
+// заняты, такие кандидаты пропускаются.
+func (m *DB) claimCandidate(ctx context.Context, p DequeueParams, qTypes []string, s *settings) (*Task, error) {
+	var busy bson.A
+	for range maxClaimAttempts {
+		filter := m.dequeueFilter(p, qTypes)
+		if len(busy) > 0 {
+			filter["$nor"] = busy
+		}
+
+		candidate := new(Task)
+		err := m.queue.FindOne(ctx, filter, options.FindOne().SetSort(dequeueSort)).Decode(candidate)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find dequeue candidate: %w", err)
+		}
+
+		// Задачи группы выдаются строго по порядку добавления, даже если у следующих приоритет выше
+		if candidate.GroupKey != "" {
+			head, err := m.groupHead(ctx, p, candidate)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find group head: %w", err)
+			}
+			if head == nil {
+				busy = append(busy, bson.D{{Key: "Type", Value: candidate.Type}, {Key: "GroupKey", Value: candidate.GroupKey}})
+				continue
+			}
+			candidate = head
+		}
+
+		slots, exclude, err := m.acquireSlots(ctx, candidate, s.typeConfig(candidate.Type))
+		if err != nil {
+			return nil, err
+		}
+		if exclude != nil {
+			busy = append(busy, exclude)
+			continue
+		}
+
+		byID := bson.M{"_id": candidate.ID, "Statuses.0.Status": "Enqueued"}
+		events := m.taskEvents(EventProcessing, candidate, "", nil, nil)
+		task, err := m.claim(ctx, byID, slots, s.lease(candidate.Type), p.Lease, events)
+		if err != nil || task == nil {
+			// задачу забрал кто-то другой - слоты больше не нужны
+			m.releaseSlots(context.WithoutCancel(ctx), slots, candidate.ID)
+		}
+		if err != nil || task != nil {
+			return task, err
+		}
+	}
+	return nil, nil
+}
+
+// reconcileSlots убирает из слотов задачи, которые уже не обрабатываются (например, если освобождение
+// слота не удалось из-за ошибки или инстанс упал между захватом слота и задачи). Между захватом слота и задачи
+// держатель какое-то время не в статусе Processing, поэтому освобождаются только держатели, которые были
+// подозрительными и при предыдущей сверке. Возвращает подозрительных держателей для следующей сверки.
+func (m *DB) reconcileSlots(ctx context.Context, suspects map[bson.ObjectID]bool) (map[bson.ObjectID]bool, error) {
+	cursor, err := m.slots.Find(ctx, bson.M{"Holders.0": bson.M{"$exists": true}})
+	if err != nil {
+		return suspects, err
+	}
+	var slots []slot
+	if err = cursor.All(ctx, &slots); err != nil {
+		return suspects, err
+	}
+
+	next := make(map[bson.ObjectID]bool)
+	for _, sl := range slots {
+		var processing []bson.ObjectID
+		err = m.queue.Distinct(ctx, "_id", bson.M{
+			"_id":               bson.M{"$in": sl.Holders},
+			"Statuses.0.Status": "Processing",
+			"Slots":             sl.ID,
+		}).Decode(&processing)
+		if err != nil {
+			return suspects, err
+		}
+
+		var stale []bson.ObjectID
+		for _, id := range sl.Holders {
+			if slices.Contains(processing, id) {
+				continue
+			}
+			if suspects[id] {
+				stale = append(stale, id)
+			} else {
+				next[id] = true
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+		if _, err = m.slots.UpdateOne(ctx, bson.M{"_id": sl.ID}, bson.M{"$pullAll": bson.M{"Holders": stale}}); err != nil {
+			return suspects, err
+		}
+		slog.WarnContext(ctx, "released stale concurrency slots", slog.Any("slot", sl.ID), slog.Int("count", len(stale)))
+		m.tryNotify(&NewTask{Namespace: sl.ID.Namespace, Type: sl.ID.Type, Priority: math.MaxInt})
+	}
+	return next, nil
+}
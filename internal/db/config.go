@@ -0,0 +1,120 @@
+package db
+
+import (
+	"github.com/spf13/viper"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPollInterval   = time.Second
+	defaultMaxResultBytes = 64 << 10
+)
+
+// settings настройки поведения очереди, которые можно менять без перезапуска
+type settings struct {
+	Tenants tenantsConfig `mapstructure:"tenants"`
+	Queue   queueConfig   `mapstructure:"queue"`
+	Events  eventsConfig  `mapstructure:"events"`
+}
+
+// queueConfig общие настройки выдачи задач и настройки отдельных типов очередей
+type queueConfig struct {
+	// PollInterval как часто ожидающие обработчики перепроверяют базу (задачи других инстансов,
+	// освободившиеся слоты, отложенные задачи)
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// Lease время, за которое обработчик должен завершить задачу, иначе она вернётся в очередь. 0 - без ограничения
+	Lease time.Duration `mapstructure:"lease"`
+	// Scheduling стратегия выбора между несколькими типами очереди (SchedulingStrategies), по умолчанию strict
+	Scheduling string `mapstructure:"scheduling"`
+	// Retention сколько хранить завершённые задачи
+	Retention RetentionConfig `mapstructure:"retention"`
+	// MaxResultBytes максимальный размер результата задачи в BSON, по умолчанию 64 KiB
+	MaxResultBytes int64 `mapstructure:"max_result_bytes"`
+	// Archive перенос завершённых задач в коллекцию queue_history
+	Archive archiveConfig              `mapstructure:"archive"`
+	Types   map[string]QueueTypeConfig `mapstructure:"types"`
+}
+
+// QueueTypeConfig настройки отдельного типа очереди
+type QueueTypeConfig struct {
+	// Lease переопределяет общее время аренды задачи
+	Lease time.Duration `mapstructure:"lease"`
+	// MaxProcessing максимальное число одновременно обрабатываемых задач. 0 - без ограничения
+	MaxProcessing int `mapstructure:"max_processing"`
+	// ConcurrencyKey ключ payload, по значениям которого лимит считается отдельно (например tenant_id)
+	ConcurrencyKey string `mapstructure:"concurrency_key"`
+	// Weight вес типа для стратегий weighted_round_robin и random_weighted, по умолчанию 1
+	Weight int `mapstructure:"weight"`
+	// Aging старение приоритета долго ожидающих задач
+	Aging AgingConfig `mapstructure:"aging"`
+	// DeadLetter тип очереди, в который попадают копии просроченных задач и задач, отменённых из-за зависимостей
+	DeadLetter string `mapstructure:"dead_letter"`
+	// Retention переопределяет общие сроки хранения завершённых задач
+	Retention RetentionConfig `mapstructure:"retention"`
+	// Push задачи этого типа отправляются на HTTP-адрес, а не ждут обработчиков на /dequeue
+	Push PushConfig `mapstructure:"push"`
+}
+
+// Configure применяет настройки из корня конфига. Вызывается при старте и при изменении файла конфигурации.
+func (m *DB) Configure(cfg *viper.Viper) {
+	var s settings
+	if err := cfg.Unmarshal(&s); err != nil {
+		slog.Error("failed to read queue settings from config, keeping previous", slog.Any("error", err))
+		return
+	}
+	for _, sub := range s.Events.Subscriptions {
+		if sub.Name == "" || sub.URL == "" {
+			slog.Warn("event subscription without name or url is ignored", slog.String("name", sub.Name))
+		}
+		for _, event := range sub.Events {
+			if !slices.Contains(EventTypes, event) {
+				slog.Warn("unknown event in subscription", slog.String("name", sub.Name), slog.String("event", event))
+			}
+		}
+	}
+	m.settings.Store(&s)
+
+	// сроки хранения могли измениться - пересчитываем их для уже завершённых задач
+	select {
+	case m.retentionChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (m *DB) config() *settings {
+	if s := m.settings.Load(); s != nil {
+		return s
+	}
+	return &settings{}
+}
+
+// typeConfig возвращает настройки типа очереди. Viper приводит ключи к нижнему регистру,
+// поэтому типы в конфиге не различаются по регистру.
+func (s *settings) typeConfig(qType string) QueueTypeConfig {
+	return s.Queue.Types[strings.ToLower(qType)]
+}
+
+// lease время аренды задачи указанного типа
+func (s *settings) lease(qType string) time.Duration {
+	if l := s.typeConfig(qType).Lease; l > 0 {
+		return l
+	}
+	return s.Queue.Lease
+}
+
+func (s *settings) maxResultBytes() int64 {
+	if s.Queue.MaxResultBytes > 0 {
+		return s.Queue.MaxResultBytes
+	}
+	return defaultMaxResultBytes
+}
+
+func (s *settings) pollInterval() time.Duration {
+	if s.Queue.PollInterval > 0 {
+		return s.Queue.PollInterval
+	}
+	return defaultPollInterval
+}
@@ -0,0 +1,317 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// blockedCheckInterval как часто перепроверяются заблокированные задачи на случай пропущенного завершения родителя
+	blockedCheckInterval = 30 * time.Second
+	blockedBatchSize     = 1000
+)
+
+// ErrDependencyNotFound задачи из depends_on нет в пространстве имён
+var ErrDependencyNotFound = errors.New("dependency not found")
+
+// parseDependencies проверяет, что все задачи, от которых зависит новая задача, существуют в пространстве имён
+func (m *DB) parseDependencies(ctx context.Context, namespace string, ids []string) ([]bson.ObjectID, error) {
+	deps := make([]bson.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		oID, err := bson.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDependencyNotFound, id)
+		}
+		if !slices.Contains(deps, oID) {
+			deps = append(deps, oID)
+		}
+	}
+
+	statuses, err := m.dependencyStatuses(ctx, namespace, deps)
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range deps {
+		if _, ok := statuses[dep]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrDependencyNotFound, dep.Hex())
+		}
+	}
+	return deps, nil
+}
+
+// dependencyStatuses текущие статусы задач из очереди и архива
+func (m *DB) dependencyStatuses(ctx context.Context, namespace string, ids []bson.ObjectID) (map[bson.ObjectID]string, error) {
+	statuses := make(map[bson.ObjectID]string, len(ids))
+	filter := bson.M{"_id": bson.M{"$in": ids}, "Namespace": namespace}
+	opts := options.Find().SetProjection(bson.M{"Statuses": bson.M{"$slice": 1}})
+	for _, coll := range []*mongo.Collection{m.queue, m.history} {
+		cursor, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find dependencies: %w", err)
+		}
+		var tasks []Task
+		if err = cursor.All(ctx, &tasks); err != nil {
+			return nil, fmt.Errorf("failed to decode dependencies: %w", err)
+		}
+		for _, t := range tasks {
+			statuses[t.ID] = t.Current().Status
+		}
+	}
+	return statuses, nil
+}
+
+// dependencyResults результаты выполнения задач группы batchID. Задачи из других групп пропускаются:
+// зависеть от них можно, но их результаты могут быть из очередей, недоступных автору группы.
+func (m *DB) dependencyResults(ctx context.Context, namespace string, batchID *bson.ObjectID, ids []bson.ObjectID) (map[bson.ObjectID]map[string]interface{}, error) {
+	results := make(map[bson.ObjectID]map[string]interface{}, len(ids))
+	if batchID == nil {
+		return results, nil
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "Namespace": namespace, "BatchID": *batchID}
+	opts := options.Find().SetProjection(bson.M{"Result": 1})
+	for _, coll := range []*mongo.Collection{m.queue, m.history} {
+		cursor, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find dependency results: %w", err)
+		}
+		var tasks []Task
+		if err = cursor.All(ctx, &tasks); err != nil {
+			return nil, fmt.Errorf("failed to decode dependency results: %w", err)
+		}
+		for _, t := range tasks {
+			results[t.ID] = t.Result
+		}
+	}
+	return results, nil
+}
+
+// resolveBlocked проверяет родителей заблокированной задачи: если все выполнены, задача ставится в очередь,
+// если какой-то завершился неудачно (или пропал, не успев выполниться), задача отменяется.
+// Выполненные родители запоминаются в задаче и больше не проверяются.
+func (m *DB) resolveBlocked(ctx context.Context, task *Task) error {
+	done := make(map[bson.ObjectID]bool, len(task.CompletedDependencies))
+	for _, dep := range task.CompletedDependencies {
+		done[dep.ID] = true
+	}
+	var unresolved []bson.ObjectID
+	for _, dep := range task.DependsOn {
+		if !done[dep] {
+			unresolved = append(unresolved, dep)
+		}
+	}
+
+	statuses, err := m.dependencyStatuses(ctx, task.Namespace, unresolved)
+	if err != nil {
+		return err
+	}
+
+	pending := false
+	var completed []bson.ObjectID
+	for _, dep := range unresolved {
+		status, ok := statuses[dep]
+		switch {
+		case !ok:
+			return m.cancelBlocked(ctx, task, fmt.Sprintf("dependency %s not found", dep.Hex()))
+		case status == "Processed":
+			completed = append(completed, dep)
+		case IsTerminal(status):
+			return m.cancelBlocked(ctx, task, fmt.Sprintf("dependency %s %s", dep.Hex(), strings.ToLower(status)))
+		default:
+			pending = true
+		}
+	}
+	if len(completed) > 0 {
+		if err = m.completeDependencies(ctx, task, completed); err != nil {
+			return err
+		}
+	}
+	if pending {
+		return nil
+	}
+	return m.unblock(ctx, task)
+}
+
+// completeDependencies запоминает в заблокированной задаче выполненных родителей и, если нужно, их результаты
+func (m *DB) completeDependencies(ctx context.Context, task *Task, ids []bson.ObjectID) error {
+	var results map[bson.ObjectID]map[string]interface{}
+	if task.CollectResults {
+		var err error
+		if results, err = m.dependencyResults(ctx, task.Namespace, task.BatchID, ids); err != nil {
+			return err
+		}
+	}
+
+	completed := make(bson.A, 0, len(ids))
+	for _, id := range ids {
+		result, collected := results[id]
+		dep := CompletedDependency{ID: id, Collected: collected, Result: result}
+		task.CompletedDependencies = append(task.CompletedDependencies, dep)
+		completed = append(completed, dep)
+	}
+	// Другой инстанс мог записать тех же родителей одновременно - повторы при чтении не мешают
+	update := bson.M{"$addToSet": bson.M{"CompletedDependencies": bson.M{"$each": completed}}}
+	if _, err := m.queue.UpdateOne(ctx, bson.M{"_id": task.ID, "Statuses.0.Status": "Blocked"}, update); err != nil {
+		return fmt.Errorf("failed to save completed dependencies: %w", err)
+	}
+	return nil
+}
+
+// unblock ставит задачу, все родители которой выполнены, в очередь и будит ожидающих обработчиков
+func (m *DB) unblock(ctx context.Context, task *Task) error {
+	update := bson.M{
+		"$push": bson.M{
+			"Statuses": bson.M{
+				"$each": bson.A{
+					bson.M{
+						"Status":    "Enqueued",
+						"Timestamp": time.Now().UTC(),
+						"Message":   "dependencies completed",
+					},
+				},
+				"$position": 0,
+			},
+		},
+	}
+	if task.CollectResults {
+		update["$set"] = bson.M{"Payload.results": collectedResults(task)}
+	}
+	err := m.queue.FindOneAndUpdate(ctx, bson.M{"_id": task.ID, "Statuses.0.Status": "Blocked"}, update).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// задачу уже разблокировал другой инстанс
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unblock task: %w", err)
+	}
+
+	m.notify(ctx, &NewTask{
+		Namespace: task.Namespace,
+		Type:      task.Type,
+		Priority:  task.EffectivePriority,
+	})
+	return nil
+}
+
+// collectedResults результаты выполненных родителей из той же группы в порядке DependsOn
+func collectedResults(task *Task) bson.A {
+	results := make(bson.A, 0, len(task.DependsOn))
+	for _, id := range task.DependsOn {
+		i := slices.IndexFunc(task.CompletedDependencies, func(dep CompletedDependency) bool { return dep.ID == id })
+		if i < 0 || !task.CompletedDependencies[i].Collected {
+			continue
+		}
+		results = append(results, bson.M{"task_id": id.Hex(), "result": task.CompletedDependencies[i].Result})
+	}
+	return results
+}
+
+// cancelBlocked отменяет задачу, которая уже не сможет выполниться, и так же поступает с зависящими от неё задачами
+func (m *DB) cancelBlocked(ctx context.Context, task *Task, message string) error {
+	cancelled, err := m.cancel(ctx, task, message, "Blocked")
+	if err != nil || !cancelled {
+		return err
+	}
+	m.deadLetter(ctx, task, message)
+	return nil
+}
+
+// cancel переводит задачу в Cancelled, если её текущий статус один из from, и перепроверяет зависящие от неё задачи
+func (m *DB) cancel(ctx context.Context, task *Task, message string, from ...string) (bool, error) {
+	now := time.Now().UTC()
+	update := bson.M{
+		"$push": bson.M{
+			"Statuses": bson.M{
+				"$each": bson.A{
+					bson.M{
+						"Status":    "Cancelled",
+						"Timestamp": now,
+						"Message":   message,
+					},
+				},
+				"$position": 0,
+			},
+		},
+	}
+	m.retentionUpdate(update, task.Type, "Cancelled", now)
+
+	err := m.queue.FindOneAndUpdate(ctx, bson.M{"_id": task.ID, "Statuses.0.Status": bson.M{"$in": from}}, update).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel task: %w", err)
+	}
+
+	slog.InfoContext(ctx, "task cancelled", slog.String("id", task.ID.Hex()), slog.String("reason", message))
+	m.archiveSoon()
+	m.Completions.changed(task.ID)
+	m.resolveDependents(ctx, task.ID)
+	return true, nil
+}
+
+// resolveDependents перепроверяет задачи, ожидающие завершившуюся задачу
+func (m *DB) resolveDependents(ctx context.Context, parent bson.ObjectID) {
+	cursor, err := m.queue.Find(ctx, bson.M{"DependsOn": parent, "Statuses.0.Status": "Blocked"})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to find dependent tasks", slog.String("id", parent.Hex()), slog.Any("error", err))
+		return
+	}
+	var tasks []Task
+	if err = cursor.All(ctx, &tasks); err != nil {
+		slog.ErrorContext(ctx, "failed to decode dependent tasks", slog.String("id", parent.Hex()), slog.Any("error", err))
+		return
+	}
+	for i := range tasks {
+		if err = m.resolveBlocked(ctx, &tasks[i]); err != nil {
+			slog.ErrorContext(ctx, "failed to resolve dependent task",
+				slog.String("id", tasks[i].ID.Hex()), slog.Any("error", err))
+		}
+	}
+}
+
+// sweepBlocked периодически перепроверяет все заблокированные задачи. Нужна на случай, если родитель
+// завершился, пока инстанс был недоступен, или между проверкой зависимостей и добавлением задачи.
+func (m *DB) sweepBlocked(ctx context.Context) {
+	ticker := time.NewTicker(blockedCheckInterval)
+	defer ticker.Stop()
+
+	// за один проход проверяется часть задач, следующий проход продолжает с места остановки
+	var after bson.ObjectID
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			filter := bson.M{"Statuses.0.Status": "Blocked", "_id": bson.M{"$gt": after}}
+			opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(blockedBatchSize)
+			cursor, err := m.queue.Find(ctx, filter, opts)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to find blocked tasks", slog.Any("error", err))
+				continue
+			}
+			var tasks []Task
+			if err = cursor.All(ctx, &tasks); err != nil {
+				slog.ErrorContext(ctx, "failed to decode blocked tasks", slog.Any("error", err))
+				continue
+			}
+			if len(tasks) < blockedBatchSize {
+				after = bson.ObjectID{}
+			} else {
+				after = tasks[len(tasks)-1].ID
+			}
+			for i := range tasks {
+				if err = m.resolveBlocked(ctx, &tasks[i]); err != nil {
+					slog.ErrorContext(ctx, "failed to resolve blocked task", slog.String("id", tasks[i].ID.Hex()), slog.Any("error", err))
+				}
+			}
+		}
+	}
+}
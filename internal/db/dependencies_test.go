@@ -0,0 +1,53 @@
+package db
+
+import (
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"reflect"
+	"testing"
+)
+
+func TestCollectedResults(t *testing.T) {
+	a, b, c := bson.NewObjectID(), bson.NewObjectID(), bson.NewObjectID()
+	resultA := map[string]interface{}{"size": 10}
+	resultC := map[string]interface{}{"url": "https://example.com/c"}
+
+	tests := []struct {
+		name string
+		task Task
+		want bson.A
+	}{
+		{name: "no dependencies", task: Task{}, want: bson.A{}},
+		{
+			name: "in depends_on order",
+			task: Task{
+				DependsOn: []bson.ObjectID{a, b, c},
+				CompletedDependencies: []CompletedDependency{
+					{ID: c, Collected: true, Result: resultC},
+					{ID: a, Collected: true, Result: resultA},
+				},
+			},
+			want: bson.A{
+				bson.M{"task_id": a.Hex(), "result": resultA},
+				bson.M{"task_id": c.Hex(), "result": resultC},
+			},
+		},
+		{
+			name: "parents from other batches are not collected",
+			task: Task{
+				DependsOn: []bson.ObjectID{a, b},
+				CompletedDependencies: []CompletedDependency{
+					{ID: a, Result: resultA},
+					{ID: b, Collected: true},
+				},
+			},
+			want: bson.A{bson.M{"task_id": b.Hex(), "result": map[string]interface{}(nil)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := collectedResults(&tt.task); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("collectedResults() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
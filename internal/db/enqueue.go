@@ -4,33 +4,138 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/morzik45/go-queue/internal/metrics"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
-	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
+	"slices"
 	"strings"
 	"time"
 )
 
+// EnqueueParams параметры новой задачи
+type EnqueueParams struct {
+	Namespace    string
+	Type         string
+	Priority     int
+	Payload      map[string]interface{}
+	Reevaluation int       // через сколько секунд задачу можно выдавать обработчикам
+	GroupKey     string    // задачи одной группы обрабатываются по одной в порядке добавления
+	ExpiresAt    time.Time // после этого момента задача не выдаётся, а переходит в Expired; нулевое - бессрочно
+	DependsOn    []string  // задача выдаётся только после успешного выполнения этих задач
+	DeadLetter   *DeadLetter
+
+	batchID        bson.ObjectID // группа, в которую входит задача
+	events         bson.A        // события о других задачах, которые сохраняются вместе с этой
+	collectResults bool          // добавить в Payload.results результаты задач группы из DependsOn
+}
+
+// DequeueParams условия выбора задачи
+type DequeueParams struct {
+	Namespace string
+	Types     []string
+	Priority  int           // минимальный приоритет
+	Lease     time.Duration // время аренды, запрошенное обработчиком; 0 - из настроек очереди
+	// Scheduling стратегия выбора между типами; пустая - из настроек очереди
+	Scheduling string
+}
+
+// dequeueSort порядок выдачи задач: сначала более приоритетные (с учётом старения), затем более старые
+var dequeueSort = bson.D{
+	{Key: "EffectivePriority", Value: -1},
+	{Key: "Statuses.0.Timestamp", Value: 1},
+}
+
+// dequeueFilter условие выбора задач, готовых к выдаче
+func (m *DB) dequeueFilter(p DequeueParams, qTypes []string) bson.M {
+	now := time.Now().UTC()
+	return bson.M{
+		"Namespace":         p.Namespace,
+		"Type":              bson.M{"$in": qTypes},
+		"EffectivePriority": bson.M{"$gte": p.Priority},
+		"Statuses.0.Status": "Enqueued",
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.D{{Key: "Statuses.0.NextReevaluation", Value: bson.M{"$exists": false}}},
+				bson.D{{Key: "Statuses.0.NextReevaluation", Value: bson.M{"$lt": now}}},
+			}},
+			notExpired(now),
+		},
+	}
+}
+
 // Enqueue добавляет задачу в очередь
-func (m *DB) Enqueue(ctx context.Context, qType string, priority int, data map[string]interface{}, reevaluation int) (string, error) {
+func (m *DB) Enqueue(ctx context.Context, p EnqueueParams) (_ string, err error) {
+	ctx, span := startSpan(ctx, "queue", "enqueue")
+	span.SetAttributes(attribute.String("queue.namespace", p.Namespace), attribute.String("queue.type", p.Type))
+	defer func() { endSpan(span, err) }()
+
+	payloadSize, err := payloadSize(p.Payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to enqueue data: %w", err)
+	}
+	if err = m.checkQuota(ctx, p.Namespace, payloadSize); err != nil {
+		return "", err
+	}
+
+	var deps []bson.ObjectID
+	if len(p.DependsOn) > 0 {
+		if deps, err = m.parseDependencies(ctx, p.Namespace, p.DependsOn); err != nil {
+			return "", err
+		}
+	}
+
 	// Prepare the document to be inserted
 	status := bson.M{
 		"Status":    "Enqueued",
 		"Timestamp": time.Now().UTC(),
 	}
-	if reevaluation > 0 {
-		status["NextReevaluation"] = time.Now().UTC().Add(time.Duration(reevaluation) * time.Second)
+	if len(deps) > 0 {
+		// в очередь задача попадёт, когда выполнятся все зависимости
+		status["Status"] = "Blocked"
+	}
+	if p.Reevaluation > 0 {
+		status["NextReevaluation"] = time.Now().UTC().Add(time.Duration(p.Reevaluation) * time.Second)
 	}
+	oid := bson.NewObjectID()
 	doc := bson.M{
-		"Statuses": bson.A{status},
-		"Type":     qType,
-		"Priority": priority,
-		"Payload":  data,
+		"_id":               oid,
+		"Statuses":          bson.A{status},
+		"Namespace":         p.Namespace,
+		"Type":              p.Type,
+		"Priority":          p.Priority,
+		"EffectivePriority": p.Priority, // растёт со временем ожидания, если для типа настроено старение
+		"Payload":           p.Payload,
+		"PayloadSize":       payloadSize,
+	}
+	if p.GroupKey != "" {
+		doc["GroupKey"] = p.GroupKey
+	}
+	if !p.ExpiresAt.IsZero() {
+		doc["ExpiresAt"] = p.ExpiresAt.UTC()
+	}
+	if len(deps) > 0 {
+		doc["DependsOn"] = deps
+		if p.collectResults {
+			doc["CollectResults"] = true
+		}
+	}
+	if !p.batchID.IsZero() {
+		doc["BatchID"] = p.batchID
+	}
+	if p.DeadLetter != nil {
+		doc["DeadLetter"] = p.DeadLetter
+	}
+	events := slices.Concat(p.events, m.taskEvents(EventEnqueued, &Task{ID: oid, Namespace: p.Namespace, Type: p.Type}, "", nil, nil))
+	if len(events) > 0 {
+		doc["PendingEvents"] = events
 	}
+	injectTraceContext(ctx, doc)
 
 	// Insert the document into MongoDB
-	res, err := m.queue.InsertOne(ctx, doc)
+	_, err = m.queue.InsertOne(ctx, doc)
 	if err != nil {
 		slog.Error("failed to insert data into MongoDB",
 			slog.String("operation", "enqueue"),
@@ -40,164 +145,347 @@ func (m *DB) Enqueue(ctx context.Context, qType string, priority int, data map[s
 		return "", fmt.Errorf("failed to enqueue data: %w", err)
 	}
 
-	// Check the type of InsertedID
-	oid, ok := res.InsertedID.(bson.ObjectID)
-	if !ok {
-		slog.ErrorContext(ctx, "Unexpected type for inserted ID",
-			slog.String("operation", "enqueue"),
-			slog.Any("error", err),
-			slog.Any("insertedID", res.InsertedID),
-		)
-		return "", fmt.Errorf("unexpected type for inserted ID: %T", res.InsertedID)
-	}
+	metrics.Enqueued.WithLabelValues(p.Namespace, p.Type).Inc()
+	m.relayEvents(ctx, m.queue, oid, events)
 
-	m.enqChan <- &NewTask{
-		Type:     qType,
-		Priority: priority,
+	if len(deps) > 0 {
+		// зависимости могли завершиться, пока задача добавлялась
+		task := &Task{ID: oid, Namespace: p.Namespace, Type: p.Type, EffectivePriority: p.Priority, Payload: p.Payload,
+			GroupKey: p.GroupKey, DependsOn: deps, CollectResults: p.collectResults}
+		if err = m.resolveBlocked(ctx, task); err != nil {
+			slog.ErrorContext(ctx, "failed to resolve task dependencies", slog.String("id", oid.Hex()), slog.Any("error", err))
+		}
+		return oid.Hex(), nil
 	}
 
+	m.notify(ctx, &NewTask{
+		Namespace: p.Namespace,
+		Type:      p.Type,
+		Priority:  p.Priority,
+	})
+
 	return oid.Hex(), nil
 }
 
 // Dequeue извлекает задачу из очереди
-func (m *DB) Dequeue(ctx context.Context, qTypes []string, priority int) (map[string]interface{}, error) {
+func (m *DB) Dequeue(ctx context.Context, p DequeueParams) (_ map[string]interface{}, err error) {
 	if ctx == nil {
 		return nil, fmt.Errorf("context cannot be nil")
 	}
 
-	var result bson.M
-	filter := bson.M{
-		"Type":              bson.M{"$in": qTypes},
-		"Priority":          bson.M{"$gte": priority},
-		"Statuses.0.Status": "Enqueued",
-		"$or": bson.A{
-			bson.D{{"Statuses.0.NextReevaluation", bson.M{"$exists": false}}},
-			bson.D{{"Statuses.0.NextReevaluation", bson.M{"$lt": time.Now().UTC()}}},
-		},
+	ctx, span := startSpan(ctx, "queue", "dequeue")
+	span.SetAttributes(attribute.String("queue.namespace", p.Namespace), attribute.StringSlice("queue.types", p.Types))
+	defer func() { endSpan(span, err) }()
+
+	qTypes := m.activeTypes(p.Namespace, p.Types)
+	if len(qTypes) == 0 {
+		return nil, nil
 	}
 
-	opts := options.FindOneAndUpdate().SetSort(bson.D{
-		{"Priority", -1},
-		{"Statuses.0.Timestamp", 1},
-	})
+	var result *Task
+	s := m.config()
+	for _, types := range m.schedule(p, qTypes, s) {
+		if result, err = m.claimCandidate(ctx, p, types, s); err != nil {
+			return nil, err
+		}
+		if result != nil {
+			break
+		}
+	}
+	if result == nil {
+		return nil, nil
+	}
 
-	status := bson.M{
-		"Status":    "Processing",
-		"Timestamp": time.Now().UTC(),
+	// result уже в статусе Processing, время ожидания считаем от предыдущего статуса
+	claimed := result.Current()
+	metrics.Dequeued.WithLabelValues(result.Namespace, result.Type).Inc()
+	if len(result.Statuses) > 1 {
+		metrics.WaitTime.WithLabelValues(result.Namespace, result.Type).Observe(claimed.Timestamp.Sub(result.Statuses[1].Timestamp).Seconds())
 	}
 
-	// TODO: Через какое время будем считать задачу невыполненной? получать это время с клиента?
-	//if reevaluation > 0 {
-	//	status["NextReevaluation"] = time.Now().UTC().Add(time.Duration(reevaluation) * time.Second)
-	//}
+	span.SetAttributes(attribute.String("queue.task_id", result.ID.Hex()))
+	if sc := producerSpanContext(result); sc.IsValid() {
+		span.AddLink(trace.Link{SpanContext: sc})
+	}
+
+	payload := result.Payload
+	if payload == nil {
+		payload = make(map[string]interface{})
+	}
+	payload["namespace"] = result.Namespace
+	payload["queue_type"] = result.Type
+	payload["id"] = result.ID.Hex()
+	if result.GroupKey != "" {
+		payload["group_key"] = result.GroupKey
+	}
+	if result.ExpiresAt != nil {
+		payload["expires_at"] = *result.ExpiresAt
+	}
+	if result.DeadLetter != nil {
+		payload["dead_letter"] = result.DeadLetter
+	}
+	payload["attempt"] = result.Attempts()
+	payload["lease_id"] = claimed.LeaseID
+	if claimed.LeaseUntil != nil {
+		payload["lease_until"] = *claimed.LeaseUntil
+	}
+	if result.TraceParent != "" {
+		payload["traceparent"] = result.TraceParent
+		if result.TraceState != "" {
+			payload["tracestate"] = result.TraceState
+		}
+	}
 
+	return payload, nil
+}
+
+// Ack помечает задачу как выполненную и сохраняет результат её выполнения, если он передан.
+// Задача подтверждается, только если всё ещё выдана по аренде leaseID.
+func (m *DB) Ack(ctx context.Context, namespace string, id string, leaseID string, result map[string]interface{}) (err error) {
+	if ctx == nil {
+		return fmt.Errorf("context cannot be nil")
+	}
+
+	ctx, span := startSpan(ctx, "queue", "ack")
+	span.SetAttributes(attribute.String("queue.task_id", id))
+	defer func() { endSpan(span, err) }()
+
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	if len(result) > 0 {
+		size, err := payloadSize(result)
+		if err != nil {
+			return err
+		}
+		if size > m.config().maxResultBytes() {
+			return ErrResultTooLarge
+		}
+	}
+
+	qType, err := m.taskType(ctx, oID)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{
+		"_id":                oID,
+		"Namespace":          namespace,
+		"Statuses.0.Status":  "Processing",
+		"Statuses.0.LeaseID": leaseID,
+	}
+
+	now := time.Now().UTC()
 	update := bson.M{
 		"$push": bson.M{
 			"Statuses": bson.M{
-				"$each":     bson.A{status},
+				"$each": bson.A{
+					bson.M{
+						"Status":    "Processed",
+						"Timestamp": now,
+					},
+				},
 				"$position": 0,
 			},
 		},
+		"$unset": bson.M{"Slots": ""},
 	}
+	if len(result) > 0 {
+		update["$set"] = bson.M{"Result": result}
+	}
+	m.retentionUpdate(update, qType, "Processed", now)
+	events := m.taskEvents(EventProcessed, &Task{ID: oID, Namespace: namespace, Type: qType}, "", result, nil)
+	pushEvents(update, events)
 
-	cursor := m.queue.FindOneAndUpdate(ctx, filter, update, opts)
-	if err := cursor.Decode(&result); err != nil {
+	var task Task
+	cursor := m.queue.FindOneAndUpdate(ctx, filter, update)
+	if err := cursor.Decode(&task); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil
+			return ErrTaskNotProcessing
 		}
-		slog.Error("failed to find data in mongodb", slog.Any("error", err))
-		return nil, fmt.Errorf("failed to dequeue data: %w", err)
+		slog.Error(
+			"failed to find data in mongodb", slog.Any("error", err),
+			slog.Any("filter", filter), slog.Any("update", update),
+		)
+		return err
 	}
-	payloadBytes, err := bson.Marshal(result["Payload"])
-	if err != nil {
-		slog.Error("failed to marshal payload", slog.Any("error", err))
-		return nil, fmt.Errorf("failed to dequeue data: %w", err)
+
+	m.releaseSlots(ctx, task.Slots, task.ID)
+	m.archiveSoon()
+	m.Completions.changed(task.ID)
+	m.relayEvents(ctx, m.queue, task.ID, events)
+	m.resolveDependents(ctx, task.ID)
+	metrics.Acked.WithLabelValues(task.Namespace, task.Type).Inc()
+	metrics.ProcessingTime.WithLabelValues(task.Namespace, task.Type).Observe(time.Since(task.Current().Timestamp).Seconds())
+	return nil
+}
+
+// Release возвращает выданную задачу в очередь, не считая это неудачной попыткой обработки.
+// Задача возвращается, только если всё ещё выдана по аренде leaseID.
+func (m *DB) Release(ctx context.Context, id, leaseID string) (err error) {
+	if ctx == nil {
+		return fmt.Errorf("context cannot be nil")
 	}
 
-	var payload map[string]interface{}
-	if err = bson.Unmarshal(payloadBytes, &payload); err != nil {
-		slog.Error("failed to unmarshal payload", slog.Any("error", err))
-		return nil, fmt.Errorf("failed to dequeue data: %w", err)
+	ctx, span := startSpan(ctx, "queue", "release")
+	span.SetAttributes(attribute.String("queue.task_id", id))
+	defer func() { endSpan(span, err) }()
+
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return err
 	}
 
-	queueType, ok := result["Type"].(string)
-	if !ok {
-		slog.Error("failed to get queue type")
+	filter := bson.M{
+		"_id":                oID,
+		"Statuses.0.Status":  "Processing",
+		"Statuses.0.LeaseID": leaseID,
 	}
-	payload["queue_type"] = queueType
 
-	id, ok := result["_id"].(bson.ObjectID)
-	if !ok {
-		slog.Error("failed to get id")
+	update := bson.M{
+		"$push": bson.M{
+			"Statuses": bson.M{
+				"$each": bson.A{
+					bson.M{
+						"Status":    "Enqueued",
+						"Timestamp": time.Now().UTC(),
+						"Message":   "released",
+					},
+				},
+				"$position": 0,
+			},
+		},
+		"$unset": bson.M{"Slots": ""},
 	}
-	payload["id"] = id.Hex()
 
-	return payload, nil
+	var task Task
+	err = m.queue.FindOneAndUpdate(ctx, filter, update).Decode(&task)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrTaskNotProcessing
+	}
+	if err != nil {
+		slog.Error("failed to release task in mongodb",
+			slog.Any("error", err), slog.Any("filter", filter), slog.Any("update", update))
+		return err
+	}
+	m.releaseSlots(ctx, task.Slots, task.ID)
+	m.Completions.changed(task.ID)
+	m.tryNotify(&NewTask{Namespace: task.Namespace, Type: task.Type, Priority: task.EffectivePriority})
+	return nil
 }
 
-// Ack помечает задачу как выполненную
-func (m *DB) Ack(ctx context.Context, id string) error {
+// Retry отмечает неудачную попытку и через delay снова ставит задачу в очередь. Используется доставкой push,
+// у которой своя политика повторов. Попытка принимается, только если задача всё ещё выдана по аренде leaseID.
+func (m *DB) Retry(ctx context.Context, namespace string, id string, leaseID string, delay time.Duration, message string) (err error) {
 	if ctx == nil {
 		return fmt.Errorf("context cannot be nil")
 	}
+
+	ctx, span := startSpan(ctx, "queue", "retry")
+	span.SetAttributes(attribute.String("queue.task_id", id))
+	defer func() { endSpan(span, err) }()
+
 	oID, err := bson.ObjectIDFromHex(id)
 	if err != nil {
 		return err
 	}
 
+	qType, err := m.taskType(ctx, oID)
+	if err != nil {
+		return err
+	}
+
 	filter := bson.M{
-		"_id":               oID,
-		"Statuses.0.Status": "Processing",
+		"_id":                oID,
+		"Namespace":          namespace,
+		"Statuses.0.Status":  "Processing",
+		"Statuses.0.LeaseID": leaseID,
 	}
 
+	now := time.Now().UTC()
+	next := now.Add(delay)
 	update := bson.M{
 		"$push": bson.M{
 			"Statuses": bson.M{
+				// поверх Failed задача снова ставится в очередь, но выдаётся только после задержки
 				"$each": bson.A{
 					bson.M{
-						"Status":    "Processed",
-						"Timestamp": time.Now().UTC(),
+						"Status":           "Enqueued",
+						"Timestamp":        now,
+						"NextReevaluation": next,
+						"Message":          "retry",
+					},
+					bson.M{
+						"Status":    "Failed",
+						"Timestamp": now,
+						"Message":   message,
 					},
 				},
 				"$position": 0,
 			},
 		},
+		"$unset": bson.M{"Slots": ""},
 	}
+	events := m.taskEvents(EventFailed, &Task{ID: oID, Namespace: namespace, Type: qType}, message, nil, &next)
+	pushEvents(update, events)
 
-	cursor := m.queue.FindOneAndUpdate(ctx, filter, update)
-	if err := cursor.Err(); err != nil {
-		slog.Error(
-			"failed to find data in mongodb", slog.Any("error", err),
-			slog.Any("filter", filter), slog.Any("update", update),
-		)
+	var task Task
+	err = m.queue.FindOneAndUpdate(ctx, filter, update).Decode(&task)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrTaskNotProcessing
+	}
+	if err != nil {
+		slog.Error("failed to retry task in mongodb",
+			slog.Any("error", err), slog.Any("filter", filter), slog.Any("update", update))
 		return err
 	}
+
+	m.releaseSlots(ctx, task.Slots, task.ID)
+	m.Completions.changed(task.ID)
+	m.relayEvents(ctx, m.queue, task.ID, events)
+	metrics.Failed.WithLabelValues(task.Namespace, task.Type).Inc()
+	metrics.ProcessingTime.WithLabelValues(task.Namespace, task.Type).Observe(time.Since(task.Current().Timestamp).Seconds())
 	return nil
 }
 
-// Failed помечает задачу как невыполненную
-func (m *DB) Failed(ctx context.Context, id string, reevaluation int, message string) error {
+// Failed помечает задачу как невыполненную.
+// Неудача принимается, только если задача всё ещё выдана по аренде leaseID.
+func (m *DB) Failed(ctx context.Context, namespace string, id string, leaseID string, reevaluation int, message string) (err error) {
 	if ctx == nil {
 		return fmt.Errorf("context cannot be nil")
 	}
 
+	ctx, span := startSpan(ctx, "queue", "fail")
+	span.SetAttributes(attribute.String("queue.task_id", id))
+	defer func() { endSpan(span, err) }()
+
 	oID, err := bson.ObjectIDFromHex(id)
 	if err != nil {
 		return err
 	}
 
+	qType, err := m.taskType(ctx, oID)
+	if err != nil {
+		return err
+	}
+
 	filter := bson.M{
-		"_id":               oID,
-		"Statuses.0.Status": "Processing",
+		"_id":                oID,
+		"Namespace":          namespace,
+		"Statuses.0.Status":  "Processing",
+		"Statuses.0.LeaseID": leaseID,
 	}
 
+	now := time.Now().UTC()
 	status := bson.M{
 		"Status":    "Failed",
-		"Timestamp": time.Now().UTC(),
+		"Timestamp": now,
 		"Message":   message,
 	}
 	if reevaluation > 0 {
-		status["NextReevaluation"] = time.Now().UTC().Add(time.Duration(reevaluation) * time.Second)
+		status["NextReevaluation"] = now.Add(time.Duration(reevaluation) * time.Second)
 	}
 	update := bson.M{
 		"$push": bson.M{
@@ -205,25 +493,45 @@ func (m *DB) Failed(ctx context.Context, id string, reevaluation int, message st
 				"$each":     bson.A{status},
 				"$position": 0,
 			},
-		}}
+		},
+		"$unset": bson.M{"Slots": ""},
+	}
+	m.retentionUpdate(update, qType, "Failed", now)
+	events := m.taskEvents(EventFailed, &Task{ID: oID, Namespace: namespace, Type: qType}, message, nil, nil)
+	pushEvents(update, events)
 
+	var task Task
 	cursor := m.queue.FindOneAndUpdate(ctx, filter, update)
-	if err := cursor.Err(); err != nil {
+	if err := cursor.Decode(&task); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrTaskNotProcessing
+		}
 		slog.Error("failed to find data in mongodb",
 			slog.Any("error", err), slog.Any("filter", filter), slog.Any("update", update))
 		return err
 	}
 
+	m.releaseSlots(ctx, task.Slots, task.ID)
+	m.Completions.changed(task.ID)
+	m.archiveSoon()
+	m.relayEvents(ctx, m.queue, task.ID, events)
+	m.resolveDependents(ctx, task.ID)
+	metrics.Failed.WithLabelValues(task.Namespace, task.Type).Inc()
+	metrics.ProcessingTime.WithLabelValues(task.Namespace, task.Type).Observe(time.Since(task.Current().Timestamp).Seconds())
 	return nil
 }
 
 // Count возвращает количество задач в очереди для заданного типа очереди и по ключу данных
-func (m *DB) Count(ctx context.Context, qType string, dataKey string, dataValue interface{}) (int64, error) {
+func (m *DB) Count(ctx context.Context, namespace string, qType string, dataKey string, dataValue interface{}) (_ int64, err error) {
 	if ctx == nil {
 		return 0, fmt.Errorf("context cannot be nil")
 	}
 
-	filter := bson.D{{"Statuses.0.Status", "Enqueued"}}
+	ctx, span := startSpan(ctx, "queue", "count")
+	span.SetAttributes(attribute.String("queue.namespace", namespace), attribute.String("queue.type", qType))
+	defer func() { endSpan(span, err) }()
+
+	filter := bson.D{{Key: "Namespace", Value: namespace}, {Key: "Statuses.0.Status", Value: "Enqueued"}}
 
 	if qType != "" {
 		filter = append(filter, bson.E{Key: "Type", Value: qType})
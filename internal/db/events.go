@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// outboxRetention сколько хранится событие, которое так и не удалось доставить
+	outboxRetention = 7 * 24 * time.Hour
+	// relayInterval как часто ищутся события, которые не удалось сразу перенести из задач в outbox
+	relayInterval  = 10 * time.Second
+	relayBatchSize = 500
+)
+
+// События жизненного цикла задачи
+const (
+	EventEnqueued     = "enqueued"
+	EventProcessing   = "processing"
+	EventProcessed    = "processed"
+	EventFailed       = "failed"
+	EventDeadLettered = "dead_lettered"
+	EventExpired      = "expired"
+)
+
+// EventTypes все события, на которые можно подписаться
+var EventTypes = []string{EventEnqueued, EventProcessing, EventProcessed, EventFailed, EventDeadLettered, EventExpired}
+
+// eventsConfig подписки на события жизненного цикла задач
+type eventsConfig struct {
+	Subscriptions []EventSubscription `mapstructure:"subscriptions"`
+}
+
+// EventSubscription куда и какие события отправлять. Параметры доставки (url, secret, timeout,
+// concurrency, max_attempts, retry_delay) такие же, как у push-очередей.
+type EventSubscription struct {
+	Name       string `mapstructure:"name"`
+	PushConfig `mapstructure:",squash"`
+	// Events события из EventTypes; пусто - все
+	Events []string `mapstructure:"events"`
+	// QueueTypes типы очередей; пусто - все
+	QueueTypes []string `mapstructure:"queue_types"`
+	// Namespaces пространства имён; пусто - все
+	Namespaces []string `mapstructure:"namespaces"`
+}
+
+func (s EventSubscription) matches(event, namespace, qType string) bool {
+	if len(s.Events) > 0 && !slices.Contains(s.Events, event) {
+		return false
+	}
+	if len(s.Namespaces) > 0 && !slices.Contains(s.Namespaces, namespace) {
+		return false
+	}
+	if len(s.QueueTypes) > 0 && !slices.ContainsFunc(s.QueueTypes, func(t string) bool { return strings.EqualFold(t, qType) }) {
+		return false
+	}
+	return true
+}
+
+// Event событие жизненного цикла задачи в outbox. Событие сначала сохраняется в самой задаче (PendingEvents)
+// тем же обновлением, что и изменение её статуса, затем переносится в outbox и удаляется после доставки,
+// поэтому не теряется при ошибке или перезапуске.
+type Event struct {
+	ID           bson.ObjectID          `bson:"_id" json:"id"`
+	Subscription string                 `bson:"Subscription" json:"-"`
+	Event        string                 `bson:"Event" json:"event"`
+	Namespace    string                 `bson:"Namespace" json:"namespace"`
+	Type         string                 `bson:"Type" json:"queue_type"`
+	TaskID       string                 `bson:"TaskID" json:"task_id"`
+	Timestamp    time.Time              `bson:"Timestamp" json:"timestamp"`
+	Message      string                 `bson:"Message,omitempty" json:"message,omitempty"`
+	Result       map[string]interface{} `bson:"Result,omitempty" json:"result,omitempty"`
+	// RetryAt когда задача будет выдана снова (для failed с повтором)
+	RetryAt *time.Time `bson:"RetryAt,omitempty" json:"retry_at,omitempty"`
+
+	Attempts    int        `bson:"Attempts" json:"-"`
+	NextAttempt *time.Time `bson:"NextAttempt,omitempty" json:"-"`
+	LastError   string     `bson:"LastError,omitempty" json:"-"`
+	ExpireAt    time.Time  `bson:"ExpireAt" json:"-"`
+}
+
+// EventSubscriptions подписки на события с заполненными параметрами доставки
+func (m *DB) EventSubscriptions() []EventSubscription {
+	subs := slices.Clone(m.config().Events.Subscriptions)
+	for i := range subs {
+		subs[i].PushConfig = subs[i].PushConfig.withDefaults()
+	}
+	return subs
+}
+
+// EventsReady сигналит, что в outbox появились новые события
+func (m *DB) EventsReady() <-chan struct{} {
+	return m.eventsNow
+}
+
+// taskEvents события для каждой подходящей подписки. Их нужно сохранить в задаче вместе с изменением,
+// о котором они сообщают (pushEvents), и затем перенести в outbox (relayEvents).
+func (m *DB) taskEvents(event string, task *Task, message string, result map[string]interface{}, retryAt *time.Time) bson.A {
+	var events bson.A
+	now := time.Now().UTC()
+	for _, sub := range m.config().Events.Subscriptions {
+		if sub.Name == "" || sub.URL == "" || !sub.matches(event, task.Namespace, task.Type) {
+			continue
+		}
+		events = append(events, Event{
+			ID:           bson.NewObjectID(),
+			Subscription: sub.Name,
+			Event:        event,
+			Namespace:    task.Namespace,
+			Type:         task.Type,
+			TaskID:       task.ID.Hex(),
+			Timestamp:    now,
+			Message:      message,
+			Result:       result,
+			RetryAt:      retryAt,
+			NextAttempt:  &now,
+			ExpireAt:     now.Add(outboxRetention),
+		})
+	}
+	return events
+}
+
+// pushEvents добавляет события в обновление задачи
+func pushEvents(update bson.M, events bson.A) {
+	if len(events) == 0 {
+		return
+	}
+	push, ok := update["$push"].(bson.M)
+	if !ok {
+		push = bson.M{}
+		update["$push"] = push
+	}
+	push["PendingEvents"] = bson.M{"$each": events}
+}
+
+// relayEvents переносит сохранённые в задаче события в outbox. Перенос можно повторять: событие, которое
+// уже есть в outbox, не дублируется. Если перенести не удалось, события перенесёт relayPending.
+func (m *DB) relayEvents(ctx context.Context, coll *mongo.Collection, taskID bson.ObjectID, events bson.A) {
+	if len(events) == 0 {
+		return
+	}
+	if err := m.insertEvents(ctx, events); err != nil {
+		slog.ErrorContext(ctx, "failed to relay task events to outbox", slog.String("id", taskID.Hex()), slog.Any("error", err))
+		return
+	}
+
+	ids := make(bson.A, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.(Event).ID)
+	}
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": taskID}, bson.M{"$pull": bson.M{"PendingEvents": bson.M{"_id": bson.M{"$in": ids}}}})
+	if err == nil {
+		// пустой список убираем, чтобы задача не попадала в индекс ожидающих событий
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": taskID, "PendingEvents": bson.M{"$size": 0}}, bson.M{"$unset": bson.M{"PendingEvents": ""}})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to remove relayed task events", slog.String("id", taskID.Hex()), slog.Any("error", err))
+	}
+
+	select {
+	case m.eventsNow <- struct{}{}:
+	default:
+	}
+}
+
+func (m *DB) insertEvents(ctx context.Context, events bson.A) error {
+	_, err := m.outbox.InsertMany(ctx, events, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil &&
+		!slices.ContainsFunc(bulkErr.WriteErrors, func(e mongo.BulkWriteError) bool { return !mongo.IsDuplicateKeyError(e) }) {
+		// все ошибки - уже перенесённые события
+		return nil
+	}
+	return err
+}
+
+// relayPending периодически переносит в outbox события, оставшиеся в задачах из-за ошибки или перезапуска
+func (m *DB) relayPending(ctx context.Context) {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// задача могла уйти в архив, не успев перенести события
+			for _, coll := range []*mongo.Collection{m.queue, m.history} {
+				if err := m.relayCollection(ctx, coll); err != nil {
+					slog.ErrorContext(ctx, "failed to relay pending task events",
+						slog.String("collection", coll.Name()), slog.Any("error", err))
+				}
+			}
+		}
+	}
+}
+
+func (m *DB) relayCollection(ctx context.Context, coll *mongo.Collection) error {
+	opts := options.Find().SetProjection(bson.M{"PendingEvents": 1}).SetLimit(relayBatchSize)
+	cursor, err := coll.Find(ctx, bson.M{"PendingEvents._id": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return err
+	}
+	var tasks []struct {
+		ID            bson.ObjectID `bson:"_id"`
+		PendingEvents []Event       `bson:"PendingEvents"`
+	}
+	if err = cursor.All(ctx, &tasks); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		events := make(bson.A, 0, len(t.PendingEvents))
+		for _, e := range t.PendingEvents {
+			events = append(events, e)
+		}
+		m.relayEvents(ctx, coll, t.ID, events)
+	}
+	return nil
+}
+
+// ClaimEvent забирает следующее событие подписки для отправки. Пока идёт отправка, событие
+// не выдаётся повторно в течение lease, после чего считается потерянным и отправляется снова.
+func (m *DB) ClaimEvent(ctx context.Context, subscription string, lease time.Duration) (*Event, error) {
+	now := time.Now().UTC()
+	filter := bson.M{"Subscription": subscription, "NextAttempt": bson.M{"$lte": now}}
+	update := bson.M{
+		"$set": bson.M{"NextAttempt": now.Add(lease)},
+		"$inc": bson.M{"Attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "NextAttempt", Value: 1}}).SetReturnDocument(options.After)
+
+	var event Event
+	err := m.outbox.FindOneAndUpdate(ctx, filter, update, opts).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim event: %w", err)
+	}
+	return &event, nil
+}
+
+// EventDelivered удаляет доставленное событие из outbox
+func (m *DB) EventDelivered(ctx context.Context, id bson.ObjectID) error {
+	_, err := m.outbox.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// EventFailed откладывает повторную отправку события. Если попытки закончились, событие остаётся
+// в outbox без следующей попытки до истечения срока хранения.
+func (m *DB) EventFailed(ctx context.Context, event *Event, sub EventSubscription, reason string) error {
+	set := bson.M{"LastError": reason}
+	update := bson.M{"$set": set}
+	if event.Attempts >= sub.MaxAttempts {
+		update["$unset"] = bson.M{"NextAttempt": ""}
+		slog.ErrorContext(ctx, "giving up on task event",
+			slog.String("subscription", sub.Name), slog.String("event", event.Event),
+			slog.String("id", event.TaskID), slog.String("error", reason))
+	} else {
+		set["NextAttempt"] = time.Now().UTC().Add(sub.RetryDelayFor(event.Attempts))
+	}
+	_, err := m.outbox.UpdateOne(ctx, bson.M{"_id": event.ID}, update)
+	return err
+}
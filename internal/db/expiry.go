@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/morzik45/go-queue/internal/metrics"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"time"
+)
+
+// expiryCheckInterval как часто просроченные задачи переводятся в статус Expired
+const expiryCheckInterval = 5 * time.Second
+
+// DeadLetter откуда пришла задача в очередь недоставленных
+type DeadLetter struct {
+	TaskID string `bson:"TaskID" json:"task_id"`
+	Type   string `bson:"Type" json:"queue_type"`
+	Reason string `bson:"Reason" json:"reason"`
+}
+
+// notExpired условие для задач, срок жизни которых ещё не истёк
+func notExpired(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.D{{Key: "ExpiresAt", Value: bson.M{"$exists": false}}},
+		bson.D{{Key: "ExpiresAt", Value: bson.M{"$gt": now}}},
+	}}
+}
+
+// sweepExpired периодически переводит просроченные задачи в статус Expired
+func (m *DB) sweepExpired(ctx context.Context) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.expireTasks(ctx); err != nil {
+				slog.ErrorContext(ctx, "failed to expire tasks", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// expireTasks переводит в статус Expired все ожидающие задачи (в том числе заблокированные зависимостями)
+// с истёкшим сроком жизни и, если для типа настроена очередь недоставленных, кладёт в неё копию задачи.
+// Зависящие от просроченной задачи отменяются.
+func (m *DB) expireTasks(ctx context.Context) error {
+	for {
+		now := time.Now().UTC()
+		filter := bson.M{
+			"Statuses.0.Status": bson.M{"$in": bson.A{"Enqueued", "Blocked"}},
+			"ExpiresAt":         bson.M{"$lte": now},
+		}
+		var task Task
+		err := m.queue.FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"Namespace": 1, "Type": 1})).Decode(&task)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		update := bson.M{
+			"$push": bson.M{
+				"Statuses": bson.M{
+					"$each": bson.A{
+						bson.M{
+							"Status":    "Expired",
+							"Timestamp": now,
+						},
+					},
+					"$position": 0,
+				},
+			},
+		}
+		m.retentionUpdate(update, task.Type, "Expired", now)
+		events := m.taskEvents(EventExpired, &task, "", nil, nil)
+		pushEvents(update, events)
+
+		filter["_id"] = task.ID
+		err = m.queue.FindOneAndUpdate(ctx, filter, update).Decode(&task)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// задачу успели выдать или отменить
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "task expired",
+			slog.String("id", task.ID.Hex()), slog.String("namespace", task.Namespace), slog.String("queue_type", task.Type))
+		metrics.Expired.WithLabelValues(task.Namespace, task.Type).Inc()
+		m.archiveSoon()
+		m.Completions.changed(task.ID)
+		m.relayEvents(ctx, m.queue, task.ID, events)
+		m.deadLetter(ctx, &task, "expired")
+		m.resolveDependents(ctx, task.ID)
+	}
+}
+
+// deadLetter кладёт копию задачи, которая не будет выполнена, в очередь недоставленных, если она настроена для типа
+func (m *DB) deadLetter(ctx context.Context, task *Task, reason string) {
+	dlq := m.config().typeConfig(task.Type).DeadLetter
+	if dlq == "" || dlq == task.Type {
+		return
+	}
+	// событие о попадании в очередь недоставленных сохраняется вместе с копией задачи
+	_, err := m.Enqueue(ctx, EnqueueParams{
+		Namespace: task.Namespace,
+		Type:      dlq,
+		Priority:  task.Priority,
+		Payload:   task.Payload,
+		GroupKey:  task.GroupKey,
+		DeadLetter: &DeadLetter{
+			TaskID: task.ID.Hex(),
+			Type:   task.Type,
+			Reason: reason,
+		},
+		events: m.taskEvents(EventDeadLettered, task, reason, nil, nil),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to route task to dead letter queue",
+			slog.String("id", task.ID.Hex()), slog.String("dead_letter", dlq), slog.Any("error", err))
+	}
+}
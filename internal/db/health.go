@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"slices"
+)
+
+const dequeueIndexName = "dequeue_idx"
+
+// requiredIndexes индексы коллекции queue, без которых сервис не считается готовым
+var requiredIndexes = []string{
+	dequeueIndexName,
+	retentionIndexName,
+}
+
+// Ping проверяет доступность MongoDB
+func (m *DB) Ping(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "admin", "ping")
+	defer func() { endSpan(span, err) }()
+
+	return m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Err()
+}
+
+// CheckIndexes проверяет, что все необходимые индексы созданы
+func (m *DB) CheckIndexes(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "queue", "listIndexes")
+	defer func() { endSpan(span, err) }()
+
+	specs, err := m.queue.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	for _, name := range requiredIndexes {
+		if !slices.Contains(names, name) {
+			return fmt.Errorf("index %s is missing", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/metrics"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"time"
+)
+
+// leaseCheckInterval как часто ищутся задачи с истёкшей арендой и сверяются слоты конкурентности
+const leaseCheckInterval = 5 * time.Second
+
+// claim переводит найденную по фильтру задачу в Processing. Занятые для задачи слоты запоминаются в ней,
+// чтобы их освободили ack, fail или истечение аренды. Возвращает задачу уже в статусе Processing
+// или nil, если подходящей задачи нет. События о выдаче сохраняются вместе с задачей.
+func (m *DB) claim(ctx context.Context, filter bson.M, slots []SlotID, lease, requested time.Duration, events bson.A) (*Task, error) {
+	now := time.Now().UTC()
+	status := bson.M{
+		"Status":    "Processing",
+		"Timestamp": now,
+		"LeaseID":   bson.NewObjectID().Hex(),
+	}
+	if requested > 0 {
+		lease = requested
+	}
+	if lease > 0 {
+		status["LeaseUntil"] = now.Add(lease)
+	}
+
+	update := bson.M{
+		"$push": bson.M{
+			"Statuses": bson.M{
+				"$each":     bson.A{status},
+				"$position": 0,
+			},
+		},
+	}
+	if len(slots) > 0 {
+		update["$set"] = bson.M{"Slots": slots}
+	}
+	// ход выполнения прошлой попытки к новой не относится
+	update["$unset"] = bson.M{"Progress": ""}
+	pushEvents(update, events)
+
+	var task Task
+	opts := options.FindOneAndUpdate().SetSort(dequeueSort).SetReturnDocument(options.After)
+	if err := m.queue.FindOneAndUpdate(ctx, filter, update, opts).Decode(&task); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		slog.Error("failed to find data in mongodb", slog.Any("error", err))
+		return nil, fmt.Errorf("failed to dequeue data: %w", err)
+	}
+	m.relayEvents(ctx, m.queue, task.ID, events)
+	return &task, nil
+}
+
+// reapLeases возвращает в очередь задачи, аренда которых истекла, и сверяет слоты конкурентности
+func (m *DB) reapLeases(ctx context.Context) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+
+	var suspects map[bson.ObjectID]bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.expireLeases(ctx); err != nil {
+				slog.ErrorContext(ctx, "failed to expire leases", slog.Any("error", err))
+			}
+			var err error
+			if suspects, err = m.reconcileSlots(ctx, suspects); err != nil {
+				slog.ErrorContext(ctx, "failed to reconcile concurrency slots", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// expireLeases возвращает в очередь все задачи с истёкшей арендой
+func (m *DB) expireLeases(ctx context.Context) error {
+	for {
+		now := time.Now().UTC()
+		filter := bson.M{
+			"Statuses.0.Status":     "Processing",
+			"Statuses.0.LeaseUntil": bson.M{"$lt": now},
+		}
+		update := bson.M{
+			"$push": bson.M{
+				"Statuses": bson.M{
+					"$each": bson.A{
+						bson.M{
+							"Status":    "Enqueued",
+							"Timestamp": now,
+							"Message":   "lease expired",
+						},
+					},
+					"$position": 0,
+				},
+			},
+			"$unset": bson.M{"Slots": ""},
+		}
+
+		var task Task
+		err := m.queue.FindOneAndUpdate(ctx, filter, update).Decode(&task)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		slog.WarnContext(ctx, "task lease expired",
+			slog.String("id", task.ID.Hex()), slog.String("namespace", task.Namespace), slog.String("queue_type", task.Type))
+		metrics.LeasesExpired.WithLabelValues(task.Namespace, task.Type).Inc()
+		m.releaseSlots(ctx, task.Slots, task.ID)
+		m.tryNotify(&NewTask{Namespace: task.Namespace, Type: task.Type, Priority: task.Priority})
+	}
+}
+
+// HeldLeases возвращает идентификаторы задач из leases (id -> lease_id), которые всё ещё обрабатываются
+// по этим арендам. Остальные задачи уже подтверждены, отмечены неудачными или возвращены в очередь.
+func (m *DB) HeldLeases(ctx context.Context, namespace string, leases map[string]string) (map[string]bool, error) {
+	ids := make([]bson.ObjectID, 0, len(leases))
+	for id := range leases {
+		if oID, err := bson.ObjectIDFromHex(id); err == nil {
+			ids = append(ids, oID)
+		}
+	}
+	held := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return held, nil
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": ids}, "Namespace": namespace, "Statuses.0.Status": "Processing"}
+	cursor, err := m.queue.Find(ctx, filter, options.Find().SetProjection(bson.M{"Statuses": bson.M{"$slice": 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find leased tasks: %w", err)
+	}
+	var tasks []Task
+	if err = cursor.All(ctx, &tasks); err != nil {
+		return nil, fmt.Errorf("failed to decode leased tasks: %w", err)
+	}
+	for _, t := range tasks {
+		if id := t.ID.Hex(); t.Current().LeaseID == leases[id] {
+			held[id] = true
+		}
+	}
+	return held, nil
+}
@@ -3,20 +3,26 @@ package db
 import (
 	"context"
 	"errors"
-	"github.com/morzik45/go-queue/pkg/utils"
+	"fmt"
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type NewTask struct {
-	Type     string
-	Priority int
+	Namespace string
+	Type      string
+	Priority  int
 }
 
+func (t *NewTask) GetNamespace() string {
+	return t.Namespace
+}
 func (t *NewTask) GetType() string {
 	return t.Type
 }
@@ -25,6 +31,7 @@ func (t *NewTask) GetPriority() int {
 }
 
 type NewTaskI interface {
+	GetNamespace() string
 	GetType() string
 	GetPriority() int
 }
@@ -33,8 +40,26 @@ type DB struct {
 	client  *mongo.Client
 	db      *mongo.Database
 	queue   *mongo.Collection
+	history *mongo.Collection
+	apiKeys *mongo.Collection
+	batches *mongo.Collection
+	outbox  *mongo.Collection
 	enqChan chan NewTaskI
 	Waiters *Queue
+	// Completions ожидание завершения задач (синхронный вызов)
+	Completions *Completions
+
+	settings atomic.Pointer[settings]
+	sched    scheduler
+
+	retentionChanged chan struct{}
+	archiveNow       chan struct{}
+	eventsNow        chan struct{}
+
+	queueStates *mongo.Collection
+	slots       *mongo.Collection
+	pausedMu    sync.Mutex
+	paused      atomic.Pointer[map[queueKey]bool]
 }
 
 func NewMongoDB(ctx context.Context, cfg *viper.Viper) (m *DB, err error) {
@@ -42,7 +67,10 @@ func NewMongoDB(ctx context.Context, cfg *viper.Viper) (m *DB, err error) {
 		return nil, errors.New("missing mongodb configuration")
 	}
 	m = &DB{
-		enqChan: make(chan NewTaskI),
+		enqChan:          make(chan NewTaskI),
+		retentionChanged: make(chan struct{}, 1),
+		archiveNow:       make(chan struct{}, 1),
+		eventsNow:        make(chan struct{}, 1),
 	}
 
 	// Use the SetServerAPIOptions() method to set the Stable API version to 1
@@ -60,53 +88,263 @@ func NewMongoDB(ctx context.Context, cfg *viper.Viper) (m *DB, err error) {
 
 	// Убедимся что база на месте
 	var result bson.M
-	if err = m.client.Database("admin").RunCommand(ctxChild, bson.D{{"ping", 1}}).Decode(&result); err != nil {
+	if err = m.client.Database("admin").RunCommand(ctxChild, bson.D{{Key: "ping", Value: 1}}).Decode(&result); err != nil {
 		slog.Error("failed to ping mongodb", slog.Any("error", err))
 	}
 
-	go utils.CloseOnContext(ctx, m)
-
 	m.db = m.client.Database(cfg.GetString("database"))
 
 	m.queue = m.db.Collection("queue")
 
+	// Задачи, созданные до появления пространств имён, относятся к пространству по умолчанию
+	_, err = m.queue.UpdateMany(ctx,
+		bson.M{"Namespace": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"Namespace": DefaultNamespace}},
+	)
+	if err != nil {
+		slog.Warn("failed to migrate tasks to default namespace", slog.Any("error", err))
+		return nil, err
+	}
+
+	// Эффективный приоритет задач, созданных до появления старения, совпадает с обычным
+	_, err = m.queue.UpdateMany(ctx,
+		bson.M{"EffectivePriority": bson.M{"$exists": false}},
+		bson.A{bson.M{"$set": bson.M{"EffectivePriority": "$Priority"}}},
+	)
+	if err != nil {
+		slog.Warn("failed to migrate tasks to effective priority", slog.Any("error", err))
+		return nil, err
+	}
+
 	// create dequeue index
-	_, err = m.queue.Indexes().CreateOne(ctx, mongo.IndexModel{
+	err = ensureIndex(ctx, m.queue, dequeueIndexName, mongo.IndexModel{
 		Keys: bson.D{
-			{"Type", 1},
-			{"Priority", -1},
-			{"Statuses.0.Status", 1},
-			{"Statuses.0.NextReevaluation", 1},
-			{"Statuses.0.Timestamp", 1},
+			{Key: "Namespace", Value: 1},
+			{Key: "Type", Value: 1},
+			{Key: "EffectivePriority", Value: -1},
+			{Key: "Statuses.0.Status", Value: 1},
+			{Key: "Statuses.0.NextReevaluation", Value: 1},
+			{Key: "Statuses.0.Timestamp", Value: 1},
 		},
-		Options: options.Index().SetName("dequeue_idx"),
 	})
 	if err != nil {
 		slog.Warn("failed to create dequeue index", slog.Any("error", err))
 		return nil, err
 	}
 
-	// create ttl index
-	const ttl int32 = 60 * 60 * 24
+	// поиск задач с истёкшей арендой
 	_, err = m.queue.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.D{{"Statuses.0.Timestamp", 1}},
-		Options: options.Index().SetExpireAfterSeconds(ttl),
+		Keys: bson.D{{Key: "Statuses.0.Status", Value: 1}, {Key: "Statuses.0.LeaseUntil", Value: 1}},
 	})
 	if err != nil {
-		slog.Warn("failed to create ttl index", slog.Any("error", err))
+		slog.Warn("failed to create lease index", slog.Any("error", err))
 		return nil, err
 	}
 
+	// поиск головы группы задач
+	_, err = m.queue.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "Namespace", Value: 1}, {Key: "Type", Value: 1}, {Key: "GroupKey", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"GroupKey": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		slog.Warn("failed to create group index", slog.Any("error", err))
+		return nil, err
+	}
+
+	// поиск просроченных задач
+	_, err = m.queue.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "Statuses.0.Status", Value: 1}, {Key: "ExpiresAt", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"ExpiresAt": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		slog.Warn("failed to create expiry index", slog.Any("error", err))
+		return nil, err
+	}
+
+	// поиск задач, ожидающих завершения других
+	_, err = m.queue.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "DependsOn", Value: 1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"DependsOn": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		slog.Warn("failed to create dependencies index", slog.Any("error", err))
+		return nil, err
+	}
+
+	// завершённые задачи удаляются по ExpireAt согласно настройкам хранения
+	if err = m.ensureRetentionIndex(ctx, m.queue); err != nil {
+		slog.Warn("failed to create retention index", slog.Any("error", err))
+		return nil, err
+	}
+
+	// архив завершённых задач со своими сроками хранения
+	m.history = m.db.Collection("queue_history")
+	if err = m.ensureRetentionIndex(ctx, m.history); err != nil {
+		slog.Warn("failed to create history retention index", slog.Any("error", err))
+		return nil, err
+	}
+	_, err = m.history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "Namespace", Value: 1}, {Key: "Type", Value: 1}, {Key: "Statuses.0.Status", Value: 1}},
+	})
+	if err != nil {
+		slog.Warn("failed to create history index", slog.Any("error", err))
+		return nil, err
+	}
+
+	// задачи группы ищутся и в очереди, и в архиве
+	for _, coll := range []*mongo.Collection{m.queue, m.history} {
+		_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "BatchID", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"BatchID": bson.M{"$exists": true}}),
+		})
+		if err != nil {
+			slog.Warn("failed to create batch index", slog.String("collection", coll.Name()), slog.Any("error", err))
+			return nil, err
+		}
+	}
+
+	// события, ещё не перенесённые из задач в outbox; задача могла уйти в архив вместе с ними
+	for _, coll := range []*mongo.Collection{m.queue, m.history} {
+		_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "PendingEvents._id", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"PendingEvents": bson.M{"$exists": true}}),
+		})
+		if err != nil {
+			slog.Warn("failed to create pending events index", slog.String("collection", coll.Name()), slog.Any("error", err))
+			return nil, err
+		}
+	}
+
+	m.batches = m.db.Collection("batches")
+	_, err = m.batches.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "CreatedAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(batchRetention.Seconds())),
+	})
+	if err != nil {
+		slog.Warn("failed to create batches index", slog.Any("error", err))
+		return nil, err
+	}
+
+	// события жизненного цикла задач, ожидающие отправки подписчикам
+	m.outbox = m.db.Collection("event_outbox")
+	_, err = m.outbox.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "Subscription", Value: 1}, {Key: "NextAttempt", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"NextAttempt": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "ExpireAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		slog.Warn("failed to create event outbox indexes", slog.Any("error", err))
+		return nil, err
+	}
+
+	m.apiKeys = m.db.Collection("api_keys")
+	_, err = m.apiKeys.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "KeyHash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		slog.Warn("failed to create api keys index", slog.Any("error", err))
+		return nil, err
+	}
+
+	m.queueStates = m.db.Collection("queue_states")
+	_, err = m.queueStates.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "Namespace", Value: 1}, {Key: "Type", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		slog.Warn("failed to create queue states index", slog.Any("error", err))
+		return nil, err
+	}
+	if err = m.refreshPauses(ctx); err != nil {
+		return nil, err
+	}
+
+	m.slots = m.db.Collection("slots")
+
 	slog.Info("connected to mongodb")
 
 	m.Waiters = NewQueue(ctx, m)
+	m.Completions = newCompletions(ctx, m)
+	go m.watchPauses(ctx)
+	go m.reapLeases(ctx)
+	go m.agePriorities(ctx)
+	go m.sweepExpired(ctx)
+	go m.watchRetention(ctx)
+	go m.archive(ctx)
+	go m.sweepBlocked(ctx)
+	go m.relayPending(ctx)
 	return m, nil
 }
 
+// ensureIndex создаёт индекс name. Если индекс с таким именем уже есть, но с другими ключами, он пересоздаётся.
+func ensureIndex(ctx context.Context, coll *mongo.Collection, name string, model mongo.IndexModel) error {
+	if model.Options == nil {
+		model.Options = options.Index()
+	}
+	model.Options.SetName(name)
+
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.Name != name {
+			continue
+		}
+		if sameIndexKeys(model.Keys.(bson.D), spec.KeysDocument) {
+			break
+		}
+		slog.Info("recreating index with new keys", slog.String("collection", coll.Name()), slog.String("index", name))
+		if err = coll.Indexes().DropOne(ctx, name); err != nil {
+			return err
+		}
+		break
+	}
+
+	_, err = coll.Indexes().CreateOne(ctx, model)
+	return err
+}
+
+func sameIndexKeys(keys bson.D, existing bson.Raw) bool {
+	var current bson.D
+	if err := bson.Unmarshal(existing, &current); err != nil || len(current) != len(keys) {
+		return false
+	}
+	for i := range keys {
+		if keys[i].Key != current[i].Key || fmt.Sprint(keys[i].Value) != fmt.Sprint(current[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
 func (m *DB) WaitTask() <-chan NewTaskI {
 	return m.enqChan
 }
 
+// notify сообщает горутине раздачи задач о новой задаче, не блокируясь дольше жизни контекста
+func (m *DB) notify(ctx context.Context, t NewTaskI) {
+	select {
+	case m.enqChan <- t:
+	case <-ctx.Done():
+	}
+}
+
+// tryNotify будит ожидающих обработчиков, только если раздача задач свободна. Используется там, где
+// ожидание могло бы заблокировать саму раздачу; пропущенное событие подхватит периодический опрос.
+func (m *DB) tryNotify(t NewTaskI) {
+	select {
+	case m.enqChan <- t:
+	default:
+	}
+}
+
 func (m *DB) Close() error {
 	return m.client.Disconnect(context.Background())
 }
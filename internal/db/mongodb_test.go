@@ -0,0 +1,41 @@
+package db
+
+import (
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"testing"
+)
+
+func TestSameIndexKeys(t *testing.T) {
+	raw := func(d bson.D) bson.Raw {
+		b, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	keys := bson.D{{Key: "Namespace", Value: 1}, {Key: "Statuses.0.Status", Value: 1}}
+
+	tests := []struct {
+		name     string
+		keys     bson.D
+		existing bson.Raw
+		want     bool
+	}{
+		{name: "same", keys: keys, existing: raw(bson.D{{Key: "Namespace", Value: 1}, {Key: "Statuses.0.Status", Value: 1}}), want: true},
+		{name: "int32 from server", keys: keys, existing: raw(bson.D{{Key: "Namespace", Value: int32(1)}, {Key: "Statuses.0.Status", Value: int32(1)}}), want: true},
+		{name: "double from server", keys: keys, existing: raw(bson.D{{Key: "Namespace", Value: 1.0}, {Key: "Statuses.0.Status", Value: 1.0}}), want: true},
+		{name: "other order", keys: keys, existing: raw(bson.D{{Key: "Statuses.0.Status", Value: 1}, {Key: "Namespace", Value: 1}})},
+		{name: "other direction", keys: keys, existing: raw(bson.D{{Key: "Namespace", Value: 1}, {Key: "Statuses.0.Status", Value: -1}})},
+		{name: "fewer keys", keys: keys, existing: raw(bson.D{{Key: "Namespace", Value: 1}})},
+		{name: "more keys", keys: keys, existing: raw(bson.D{{Key: "Namespace", Value: 1}, {Key: "Statuses.0.Status", Value: 1}, {Key: "Type", Value: 1}})},
+		{name: "string index type", keys: bson.D{{Key: "Payload", Value: "hashed"}}, existing: raw(bson.D{{Key: "Payload", Value: "hashed"}}), want: true},
+		{name: "invalid document", keys: keys, existing: bson.Raw{0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameIndexKeys(tt.keys, tt.existing); got != tt.want {
+				t.Errorf("sameIndexKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
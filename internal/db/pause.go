@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// pauseRefreshInterval как часто инстанс перечитывает состояние очередей, изменённое другими инстансами
+const pauseRefreshInterval = time.Second
+
+// QueueState состояние типа очереди в коллекции queue_states
+type QueueState struct {
+	Namespace string    `bson:"Namespace" json:"namespace"`
+	Type      string    `bson:"Type" json:"queue_type"`
+	Paused    bool      `bson:"Paused" json:"paused"`
+	UpdatedAt time.Time `bson:"UpdatedAt" json:"updated_at"`
+}
+
+// Wakeup просит раздать задачи типа очереди всем подходящим ожидающим обработчикам (например, после снятия паузы)
+type Wakeup struct {
+	Namespace string
+	Type      string
+}
+
+func (w *Wakeup) GetNamespace() string {
+	return w.Namespace
+}
+func (w *Wakeup) GetType() string {
+	return w.Type
+}
+func (w *Wakeup) GetPriority() int {
+	return math.MaxInt
+}
+
+type queueKey struct {
+	namespace string
+	qType     string
+}
+
+// Pause останавливает выдачу задач типа очереди. Добавлять задачи можно и дальше.
+func (m *DB) Pause(ctx context.Context, namespace, qType string) error {
+	if err := m.setPaused(ctx, namespace, qType, true); err != nil {
+		return err
+	}
+	return m.refreshPauses(ctx)
+}
+
+// Resume возобновляет выдачу задач типа очереди и будит ожидающих обработчиков
+func (m *DB) Resume(ctx context.Context, namespace, qType string) error {
+	if err := m.setPaused(ctx, namespace, qType, false); err != nil {
+		return err
+	}
+	return m.refreshPauses(ctx)
+}
+
+// Paused сообщает, приостановлена ли выдача задач типа очереди
+func (m *DB) Paused(namespace, qType string) bool {
+	paused := m.paused.Load()
+	return paused != nil && (*paused)[queueKey{namespace, qType}]
+}
+
+// PausedQueues возвращает приостановленные типы очередей пространства имён
+func (m *DB) PausedQueues(ctx context.Context, namespace string) (_ []QueueState, err error) {
+	ctx, span := startSpan(ctx, "queue_states", "find")
+	defer func() { endSpan(span, err) }()
+
+	cursor, err := m.queueStates.Find(ctx, bson.M{"Namespace": namespace, "Paused": true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find paused queues: %w", err)
+	}
+	result := make([]QueueState, 0)
+	if err = cursor.All(ctx, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode paused queues: %w", err)
+	}
+	return result, nil
+}
+
+// activeTypes убирает из списка приостановленные типы очередей
+func (m *DB) activeTypes(namespace string, qTypes []string) []string {
+	active := make([]string, 0, len(qTypes))
+	for _, qType := range qTypes {
+		if !m.Paused(namespace, qType) {
+			active = append(active, qType)
+		}
+	}
+	return active
+}
+
+func (m *DB) setPaused(ctx context.Context, namespace, qType string, paused bool) (err error) {
+	ctx, span := startSpan(ctx, "queue_states", "update")
+	defer func() { endSpan(span, err) }()
+
+	_, err = m.queueStates.UpdateOne(ctx,
+		bson.M{"Namespace": namespace, "Type": qType},
+		bson.M{"$set": bson.M{"Paused": paused, "UpdatedAt": time.Now().UTC()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		slog.Error("failed to update queue state", slog.Any("error", err),
+			slog.String("namespace", namespace), slog.String("queue_type", qType), slog.Bool("paused", paused))
+		return fmt.Errorf("failed to update queue state: %w", err)
+	}
+	return nil
+}
+
+// refreshPauses перечитывает приостановленные очереди. Для очередей, с которых сняли паузу
+// (в том числе на другом инстансе), будит ожидающих обработчиков.
+func (m *DB) refreshPauses(ctx context.Context) (err error) {
+	m.pausedMu.Lock()
+	defer m.pausedMu.Unlock()
+
+	ctx, span := startSpan(ctx, "queue_states", "find")
+	defer func() { endSpan(span, err) }()
+
+	cursor, err := m.queueStates.Find(ctx, bson.M{"Paused": true})
+	if err != nil {
+		return fmt.Errorf("failed to load paused queues: %w", err)
+	}
+	var states []QueueState
+	if err = cursor.All(ctx, &states); err != nil {
+		return fmt.Errorf("failed to decode paused queues: %w", err)
+	}
+
+	paused := make(map[queueKey]bool, len(states))
+	for _, s := range states {
+		paused[queueKey{s.Namespace, s.Type}] = true
+	}
+
+	previous := m.paused.Swap(&paused)
+
+	if previous == nil {
+		return nil
+	}
+	for key := range *previous {
+		if paused[key] {
+			continue
+		}
+		w := Wakeup{Namespace: key.namespace, Type: key.qType}
+		slog.InfoContext(ctx, "queue resumed", slog.String("namespace", w.Namespace), slog.String("queue_type", w.Type))
+		m.notify(ctx, &w)
+	}
+	return nil
+}
+
+// watchPauses периодически перечитывает состояние очередей, пока не отменён контекст
+func (m *DB) watchPauses(ctx context.Context) {
+	ticker := time.NewTicker(pauseRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.refreshPauses(ctx); err != nil {
+				slog.WarnContext(ctx, "failed to refresh paused queues", slog.Any("error", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func pausedDB(keys ...queueKey) *DB {
+	m := &DB{}
+	paused := make(map[queueKey]bool, len(keys))
+	for _, key := range keys {
+		paused[key] = true
+	}
+	m.paused.Store(&paused)
+	return m
+}
+
+func TestActiveTypes(t *testing.T) {
+	m := pausedDB(queueKey{"default", "emails"}, queueKey{"acme", "reports"})
+	tests := []struct {
+		name      string
+		namespace string
+		qTypes    []string
+		want      []string
+	}{
+		{name: "paused type is skipped", namespace: "default", qTypes: []string{"emails", "reports"}, want: []string{"reports"}},
+		{name: "pause is per namespace", namespace: "acme", qTypes: []string{"emails", "reports"}, want: []string{"emails"}},
+		{name: "type case matters", namespace: "default", qTypes: []string{"Emails"}, want: []string{"Emails"}},
+		{name: "all paused", namespace: "default", qTypes: []string{"emails"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.activeTypes(tt.namespace, tt.qTypes); !slices.Equal(got, tt.want) {
+				t.Errorf("activeTypes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDequeueSkipsPausedQueues(t *testing.T) {
+	// все запрошенные типы приостановлены, поэтому до базы запрос не доходит
+	m := pausedDB(queueKey{"default", "emails"}, queueKey{"default", "reports"})
+	task, err := m.Dequeue(context.Background(), DequeueParams{Namespace: "default", Types: []string{"emails", "reports"}})
+	if err != nil || task != nil {
+		t.Errorf("Dequeue() = %v, %v, want no task", task, err)
+	}
+	if !m.Paused("default", "emails") || m.Paused("acme", "emails") {
+		t.Error("Paused() does not match the paused queues")
+	}
+}
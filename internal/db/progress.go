@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"time"
+)
+
+// ErrTaskNotProcessing задача не выдана обработчику или выдана по другой аренде
+var ErrTaskNotProcessing = errors.New("task is not being processed")
+
+// Progress ход выполнения задачи, о котором сообщает обработчик
+type Progress struct {
+	Percent   float64   `bson:"Percent" json:"percent"`
+	Message   string    `bson:"Message,omitempty" json:"message,omitempty"`
+	UpdatedAt time.Time `bson:"UpdatedAt" json:"updated_at"`
+}
+
+// ProgressParams отчёт о ходе выполнения
+type ProgressParams struct {
+	Percent float64
+	Message string
+	LeaseID string        // отчёт принимается только от аренды, по которой выдана задача
+	Extend  time.Duration // продлить аренду на это время от текущего момента, но не больше чем на maxExtend
+}
+
+// ReportProgress сохраняет ход выполнения задачи в статусе Processing и, если нужно, продлевает аренду
+func (m *DB) ReportProgress(ctx context.Context, namespace, id string, p ProgressParams) (err error) {
+	ctx, span := startSpan(ctx, "queue", "progress")
+	span.SetAttributes(attribute.String("queue.task_id", id))
+	defer func() { endSpan(span, err) }()
+
+	oID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrTaskNotFound
+	}
+
+	filter := bson.M{
+		"_id":                oID,
+		"Namespace":          namespace,
+		"Statuses.0.Status":  "Processing",
+		"Statuses.0.LeaseID": p.LeaseID,
+	}
+
+	now := time.Now().UTC()
+	set := bson.M{"Progress": Progress{Percent: p.Percent, Message: p.Message, UpdatedAt: now}}
+	if p.Extend > 0 {
+		var task Task
+		opts := options.FindOne().SetProjection(bson.M{"Type": 1, "Statuses": bson.M{"$slice": 1}})
+		err = m.queue.FindOne(ctx, filter, opts).Decode(&task)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrTaskNotProcessing
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find task: %w", err)
+		}
+		if extend := min(p.Extend, m.config().maxExtend(task.Type, task.Current())); extend > 0 {
+			set["Statuses.0.LeaseUntil"] = now.Add(extend)
+		}
+	}
+
+	err = m.queue.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrTaskNotProcessing
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to save task progress", slog.String("id", id), slog.Any("error", err))
+		return fmt.Errorf("failed to save task progress: %w", err)
+	}
+
+	m.Completions.changed(oID)
+	return nil
+}
+
+// maxExtend на сколько можно продлить аренду задачи: не больше времени аренды типа из настроек, а если оно
+// не задано - не больше аренды, с которой задача была выдана. Задачу без аренды продлевать не нужно.
+func (s *settings) maxExtend(qType string, claimed Status) time.Duration {
+	if l := s.lease(qType); l > 0 {
+		return l
+	}
+	if claimed.LeaseUntil != nil {
+		return claimed.LeaseUntil.Sub(claimed.Timestamp)
+	}
+	return 0
+}
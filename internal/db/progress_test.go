@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxExtend(t *testing.T) {
+	s := settingsFrom(t, `
+queue:
+  lease: 5m
+  types:
+    Reports:
+      lease: 1h
+`)
+	unlimited := settingsFrom(t, "queue:\n  types: {}\n")
+	claimedAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	leaseUntil := claimedAt.Add(10 * time.Minute)
+
+	tests := []struct {
+		name    string
+		s       *settings
+		qType   string
+		claimed Status
+		want    time.Duration
+	}{
+		{name: "type lease", s: s, qType: "reports", want: time.Hour},
+		{name: "default lease", s: s, qType: "emails", want: 5 * time.Minute},
+		{
+			name:    "configured lease wins over requested",
+			s:       s,
+			qType:   "emails",
+			claimed: Status{Status: "Processing", Timestamp: claimedAt, LeaseUntil: &leaseUntil},
+			want:    5 * time.Minute,
+		},
+		{
+			name:    "requested lease without configured",
+			s:       unlimited,
+			qType:   "emails",
+			claimed: Status{Status: "Processing", Timestamp: claimedAt, LeaseUntil: &leaseUntil},
+			want:    10 * time.Minute,
+		},
+		{name: "no lease", s: unlimited, qType: "emails", claimed: Status{Status: "Processing", Timestamp: claimedAt}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.maxExtend(tt.qType, tt.claimed); got != tt.want {
+				t.Errorf("maxExtend() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+const (
+	defaultPushTimeout     = 30 * time.Second
+	defaultPushRetryDelay  = 10 * time.Second
+	defaultPushMaxAttempts = 5
+)
+
+// PushConfig доставка задач POST-запросом на URL. Ответ 2xx подтверждает задачу, любой другой ответ
+// или ошибка считаются неудачей и задача повторяется через RetryDelay, пока не исчерпаны попытки.
+type PushConfig struct {
+	URL string `mapstructure:"url"`
+	// Secret ключ HMAC-SHA256 подписи запроса (заголовки X-Queue-Timestamp и X-Queue-Signature)
+	Secret string `mapstructure:"secret"`
+	// Timeout сколько ждать ответа, по умолчанию 30s
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Concurrency сколько запросов одновременно отправляется на URL, по умолчанию 1
+	Concurrency int `mapstructure:"concurrency"`
+	// MaxAttempts сколько раз отправлять задачу, по умолчанию 5
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// RetryDelay задержка перед повтором, удваивается с каждой попыткой; по умолчанию 10s
+	RetryDelay time.Duration `mapstructure:"retry_delay"`
+	// Namespaces пространства имён, задачи которых отправляются; по умолчанию только default
+	Namespaces []string `mapstructure:"namespaces"`
+}
+
+// withDefaults заполняет незаданные параметры значениями по умолчанию
+func (c PushConfig) withDefaults() PushConfig {
+	if c.Timeout <= 0 {
+		c.Timeout = defaultPushTimeout
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultPushMaxAttempts
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = defaultPushRetryDelay
+	}
+	return c
+}
+
+// RetryDelayFor задержка перед следующей отправкой после неудачной попытки attempt (с 1)
+func (c PushConfig) RetryDelayFor(attempt int) time.Duration {
+	return c.RetryDelay << min(max(attempt-1, 0), 16)
+}
+
+// PushQueue очередь с настроенной отправкой
+type PushQueue struct {
+	Namespace string
+	Type      string
+	Push      PushConfig
+}
+
+// PushQueues возвращает очереди с настроенной отправкой. Очереди берутся из настроек типов, поэтому тип
+// задач такой, как в ключе конфига: viper приводит ключи к нижнему регистру.
+func (m *DB) PushQueues() []PushQueue {
+	var queues []PushQueue
+	for qType, t := range m.config().Queue.Types {
+		if t.Push.URL == "" {
+			continue
+		}
+		namespaces := t.Push.Namespaces
+		if len(namespaces) == 0 {
+			namespaces = []string{DefaultNamespace}
+		}
+		for _, namespace := range namespaces {
+			queues = append(queues, PushQueue{Namespace: namespace, Type: qType, Push: t.Push.withDefaults()})
+		}
+	}
+	slices.SortFunc(queues, func(a, b PushQueue) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Type, b.Type))
+	})
+	return queues
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPushQueues(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []PushQueue
+	}{
+		{name: "no push types", yaml: "queue:\n  types:\n    emails:\n      weight: 2\n"},
+		{
+			name: "default namespace and defaults",
+			yaml: `
+queue:
+  types:
+    Emails:
+      push:
+        url: https://example.com/emails
+    reports: {}
+`,
+			want: []PushQueue{{
+				Namespace: DefaultNamespace,
+				Type:      "emails",
+				Push: PushConfig{
+					URL:         "https://example.com/emails",
+					Timeout:     defaultPushTimeout,
+					Concurrency: 1,
+					MaxAttempts: defaultPushMaxAttempts,
+					RetryDelay:  defaultPushRetryDelay,
+				},
+			}},
+		},
+		{
+			name: "several namespaces",
+			yaml: `
+queue:
+  types:
+    hooks:
+      push:
+        url: https://example.com/hooks
+        timeout: 5s
+        concurrency: 3
+        namespaces: [tenant, acme]
+`,
+			want: []PushQueue{
+				{Namespace: "acme", Type: "hooks"},
+				{Namespace: "tenant", Type: "hooks"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &DB{}
+			m.settings.Store(settingsFrom(t, tt.yaml))
+			got := m.PushQueues()
+			if len(got) != len(tt.want) {
+				t.Fatalf("PushQueues() = %+v, want %+v", got, tt.want)
+			}
+			for i, want := range tt.want {
+				if got[i].Namespace != want.Namespace || got[i].Type != want.Type {
+					t.Errorf("PushQueues()[%d] = %s/%s, want %s/%s", i, got[i].Namespace, got[i].Type, want.Namespace, want.Type)
+				}
+				if want.Push.URL != "" && !pushConfigEqual(got[i].Push, want.Push) {
+					t.Errorf("PushQueues()[%d].Push = %+v, want %+v", i, got[i].Push, want.Push)
+				}
+			}
+		})
+	}
+}
+
+func pushConfigEqual(a, b PushConfig) bool {
+	return a.URL == b.URL && a.Secret == b.Secret && a.Timeout == b.Timeout && a.Concurrency == b.Concurrency &&
+		a.MaxAttempts == b.MaxAttempts && a.RetryDelay == b.RetryDelay && slices.Equal(a.Namespaces, b.Namespaces)
+}
+
+func TestRetryDelayFor(t *testing.T) {
+	c := PushConfig{RetryDelay: 10 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 0, want: 10 * time.Second},
+		{attempt: 1, want: 10 * time.Second},
+		{attempt: 2, want: 20 * time.Second},
+		{attempt: 4, want: 80 * time.Second},
+		{attempt: 100, want: 10 * time.Second << 16},
+	}
+	for _, tt := range tests {
+		if got := c.RetryDelayFor(tt.attempt); got != tt.want {
+			t.Errorf("RetryDelayFor(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
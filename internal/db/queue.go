@@ -2,28 +2,71 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/metrics"
 	"log/slog"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Waiter struct {
-	QueueTypes []string
-	Priority   int
-	Ch         chan map[string]interface{}
+	DequeueParams
+	Ch chan map[string]interface{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// deliver передаёт задачу ожидающему обработчику. Возвращает false, если обработчик уже
+// перестал ждать или уже получил задачу - тогда задачу нужно вернуть в очередь.
+func (w *Waiter) deliver(task map[string]interface{}) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.Ch <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// close запрещает дальнейшую доставку и возвращает задачу, которая успела прийти, но не была прочитана
+func (w *Waiter) close() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	select {
+	case task := <-w.Ch:
+		return task
+	default:
+		return nil
+	}
 }
 
 type Queue struct {
-	waiters []Waiter
+	waiters []*Waiter
 	mu      *sync.RWMutex
 	store   *DB
+	alive   atomic.Bool
+	done    chan struct{}
+
+	drainOnce sync.Once
+	drain     chan struct{}
 }
 
 func NewQueue(ctx context.Context, store *DB) *Queue {
 	q := Queue{
-		waiters: make([]Waiter, 0),
+		waiters: make([]*Waiter, 0),
 		store:   store,
 		mu:      new(sync.RWMutex),
+		done:    make(chan struct{}),
+		drain:   make(chan struct{}),
 	}
 
 	go q.watch(ctx)
@@ -32,71 +75,187 @@ func NewQueue(ctx context.Context, store *DB) *Queue {
 }
 
 func (q *Queue) watch(ctx context.Context) {
+	q.alive.Store(true)
+	defer close(q.done)
+	defer q.alive.Store(false)
+
+	interval := q.store.config().pollInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case t := <-q.store.WaitTask():
-			for _, w := range q.waiters {
-				if slices.Contains(w.QueueTypes, t.GetType()) && t.GetPriority() >= w.Priority {
+			if q.store.Paused(t.GetNamespace(), t.GetType()) {
+				continue
+			}
+
+			q.mu.RLock()
+			waiters := slices.Clone(q.waiters)
+			q.mu.RUnlock()
+
+			_, wakeup := t.(*Wakeup)
+			for _, w := range waiters {
+				if w.Namespace == t.GetNamespace() && slices.Contains(w.Types, t.GetType()) && t.GetPriority() >= w.Priority {
 					// Пробуем вытащить из базы
-					task, err := q.store.Dequeue(ctx, w.QueueTypes, w.Priority)
-					if err != nil {
-						slog.ErrorContext(ctx, "dequeue error", slog.Any("error", err))
+					if _, delivered := q.offer(ctx, w); !delivered {
+						continue
 					}
-					if task != nil {
-						// Если получилось, то возвращаем
-						w.Ch <- task
+					// Пробуждение раздаёт задачи всем ожидающим, пока они есть
+					if !wakeup {
 						break
 					}
 				}
 			}
+		case <-ticker.C:
+			q.poll(ctx)
+			if i := q.store.config().pollInterval(); i != interval {
+				interval = i
+				ticker.Reset(interval)
+			}
+		}
+	}
+}
+
+// poll перепроверяет базу для всех ожидающих. Так обработчики получают задачи, о которых этот инстанс
+// не знает: добавленные другими инстансами, освободившиеся слоты, наступившие отложенные задачи.
+func (q *Queue) poll(ctx context.Context) {
+	q.mu.RLock()
+	waiters := slices.Clone(q.waiters)
+	q.mu.RUnlock()
+
+	// Ожидающим с одинаковыми условиями нет смысла повторять запрос, который уже ничего не нашёл
+	empty := make(map[string]bool)
+	for _, w := range waiters {
+		key := fmt.Sprint(w.Namespace, w.Types, w.Priority)
+		if empty[key] {
+			continue
+		}
+		if found, _ := q.offer(ctx, w); !found {
+			empty[key] = true
 		}
 	}
 }
 
-func (q *Queue) Dequeue(ctx context.Context, queueTypes []string, priority int) (map[string]interface{}, error) {
+// offer забирает из базы задачу для ожидающего и передаёт её ему. Сообщает, нашлась ли задача
+// и удалось ли её доставить.
+func (q *Queue) offer(ctx context.Context, w *Waiter) (found, delivered bool) {
+	task, err := q.store.Dequeue(ctx, w.DequeueParams)
+	if err != nil {
+		slog.ErrorContext(ctx, "dequeue error", slog.Any("error", err))
+	}
+	if task == nil {
+		return false, false
+	}
+	if !w.deliver(task) {
+		// Обработчик ушёл, пока мы забирали задачу из базы - возвращаем задачу
+		q.release(ctx, task)
+		return true, false
+	}
+	return true, true
+}
+
+// Alive сообщает, работает ли горутина, раздающая новые задачи ожидающим обработчикам
+func (q *Queue) Alive() bool {
+	return q.alive.Load()
+}
+
+// Done закрывается, когда горутина раздачи задач завершила работу
+func (q *Queue) Done() <-chan struct{} {
+	return q.done
+}
+
+// Drain переводит очередь в режим остановки: новые обработчики не принимаются,
+// а все ожидающие сразу получают ответ "нет задач"
+func (q *Queue) Drain() {
+	q.drainOnce.Do(func() {
+		close(q.drain)
+	})
+}
+
+// Draining сообщает, что очередь находится в режиме остановки
+func (q *Queue) Draining() bool {
+	select {
+	case <-q.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *Queue) Dequeue(ctx context.Context, p DequeueParams) (map[string]interface{}, error) {
+	if q.Draining() {
+		return nil, nil
+	}
+
 	// Пробуем вытащить из базы
-	task, err := q.store.Dequeue(ctx, queueTypes, priority)
+	task, err := q.store.Dequeue(ctx, p)
 	if err != nil || task != nil {
 		// Если получилось (или получили ошибку), то возвращаем
 		return task, err
 	}
 
 	// Добавляем в список ожидания
-	ch, c := q.Subscribe(queueTypes, priority)
-	defer c()
+	ch, c := q.Subscribe(p)
+
+	ctx, span := tracer.Start(ctx, "queue.wait")
+	defer span.End()
 
 	slog.DebugContext(ctx, "waiting for task")
 	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-
 	case task = <-ch:
+		c()
 		return task, nil
+
+	case <-q.drain:
+		// Клиент ещё на связи, поэтому успевшую прийти задачу можно отдать
+		return c(), nil
+
+	case <-ctx.Done():
+		if task = c(); task != nil {
+			// Клиент уже не получит задачу, возвращаем её в очередь
+			q.release(ctx, task)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, nil
+		}
+		return nil, ctx.Err()
 	}
 }
 
-func (q *Queue) Subscribe(queueTypes []string, priority int) (<-chan map[string]interface{}, func()) {
+// Subscribe добавляет обработчика в список ожидания. Возвращаемая функция убирает его из списка
+// и возвращает задачу, если она была доставлена, но ещё не прочитана из канала.
+func (q *Queue) Subscribe(p DequeueParams) (<-chan map[string]interface{}, func() map[string]interface{}) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	ch := make(chan map[string]interface{}, 1)
-	q.waiters = append(q.waiters, Waiter{
-		QueueTypes: queueTypes,
-		Priority:   priority,
-		Ch:         ch,
-	})
+	w := &Waiter{
+		DequeueParams: p,
+		Ch:            make(chan map[string]interface{}, 1),
+	}
+	q.waiters = append(q.waiters, w)
+	metrics.Waiters.Inc()
 
-	return ch, func() {
+	return w.Ch, func() map[string]interface{} {
 		q.mu.Lock()
-		defer q.mu.Unlock()
-		for i, channel := range q.waiters {
-			if channel.Ch == ch {
-				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
-				close(ch)
-				break
-			}
+		if i := slices.Index(q.waiters, w); i >= 0 {
+			q.waiters = slices.Delete(q.waiters, i, i+1)
+			metrics.Waiters.Dec()
 		}
+		q.mu.Unlock()
+		return w.close()
+	}
+}
+
+// release возвращает выданную, но не доставленную задачу в очередь
+func (q *Queue) release(ctx context.Context, task map[string]interface{}) {
+	id, _ := task["id"].(string)
+	leaseID, _ := task["lease_id"].(string)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := q.store.Release(ctx, id, leaseID); err != nil {
+		slog.ErrorContext(ctx, "failed to release undelivered task", slog.String("id", id), slog.Any("error", err))
 	}
 }
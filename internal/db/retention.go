@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"log/slog"
+	"time"
+)
+
+const (
+	// retentionIndexName ttl индекс, удаляющий задачи по полю ExpireAt
+	retentionIndexName = "expire_at_ttl"
+	// legacyTTLIndexName старый ttl индекс, удалявший через сутки любые задачи, включая ожидающие
+	legacyTTLIndexName = "Statuses.0.Timestamp_1"
+	// defaultRetention сколько хранятся завершённые задачи, если срок не задан
+	defaultRetention = 24 * time.Hour
+)
+
+// terminalStatuses статусы, после которых задача больше не меняется. Только такие задачи удаляются.
+var terminalStatuses = []string{"Processed", "Failed", "Cancelled", "Expired"}
+
+// RetentionConfig сколько хранить завершённые задачи в каждом из конечных статусов.
+// 0 - взять значение уровнем выше (общее или 24 часа), отрицательное значение - хранить бессрочно.
+type RetentionConfig struct {
+	Processed time.Duration `mapstructure:"processed"`
+	Failed    time.Duration `mapstructure:"failed"`
+	Cancelled time.Duration `mapstructure:"cancelled"`
+	Expired   time.Duration `mapstructure:"expired"`
+}
+
+func (r RetentionConfig) forStatus(status string) time.Duration {
+	switch status {
+	case "Processed":
+		return r.Processed
+	case "Failed":
+		return r.Failed
+	case "Cancelled":
+		return r.Cancelled
+	case "Expired":
+		return r.Expired
+	}
+	return 0
+}
+
+// retention срок хранения задачи типа qType в статусе status. Отрицательный - хранить бессрочно.
+func (s *settings) retention(qType, status string) time.Duration {
+	if d := s.typeConfig(qType).Retention.forStatus(status); d != 0 {
+		return d
+	}
+	if d := s.Queue.Retention.forStatus(status); d != 0 {
+		return d
+	}
+	return defaultRetention
+}
+
+// retentionUpdate добавляет в обновление задачи, переходящей в статус status, момент её удаления
+func (m *DB) retentionUpdate(update bson.M, qType, status string, now time.Time) {
+	d := m.config().retention(qType, status)
+	if d < 0 {
+		return
+	}
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	set["ExpireAt"] = now.Add(d)
+}
+
+// taskType возвращает тип задачи, чтобы заранее узнать её срок хранения. Если задача уже в архиве,
+// возвращает ErrTaskNotProcessing, а если её нет и там - ErrTaskNotFound.
+func (m *DB) taskType(ctx context.Context, id bson.ObjectID) (string, error) {
+	var task struct {
+		Type string `bson:"Type"`
+	}
+	err := m.queue.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"Type": 1})).Decode(&task)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return task.Type, err
+	}
+	err = m.history.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrTaskNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", ErrTaskNotProcessing
+}
+
+// ensureRetentionIndex создаёт ttl индекс по ExpireAt и удаляет старый ttl индекс по времени последнего статуса
+func (m *DB) ensureRetentionIndex(ctx context.Context, coll *mongo.Collection) error {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	var existing *mongo.IndexSpecification
+	for _, spec := range specs {
+		switch spec.Name {
+		case legacyTTLIndexName:
+			slog.Info("dropping legacy ttl index", slog.String("index", spec.Name))
+			if err = coll.Indexes().DropOne(ctx, spec.Name); err != nil {
+				return err
+			}
+		case retentionIndexName:
+			existing = &spec
+		}
+	}
+
+	if existing == nil {
+		_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "ExpireAt", Value: 1}},
+			Options: options.Index().SetName(retentionIndexName).SetExpireAfterSeconds(0),
+		})
+		return err
+	}
+	if existing.ExpireAfterSeconds != nil && *existing.ExpireAfterSeconds == 0 {
+		return nil
+	}
+	// индекс создан с другим сроком - меняем его на месте
+	return m.db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: coll.Name()},
+		{Key: "index", Value: bson.D{{Key: "name", Value: retentionIndexName}, {Key: "expireAfterSeconds", Value: 0}}},
+	}).Err()
+}
+
+// watchRetention пересчитывает сроки удаления завершённых задач после изменения настроек хранения
+func (m *DB) watchRetention(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.retentionChanged:
+			s := m.config()
+			if err := m.applyRetention(ctx, m.queue, s.retention); err != nil {
+				slog.ErrorContext(ctx, "failed to apply retention policies", slog.Any("error", err))
+			}
+			if err := m.applyRetention(ctx, m.history, s.archiveRetention); err != nil {
+				slog.ErrorContext(ctx, "failed to apply archive retention policies", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// applyRetention пересчитывает ExpireAt всех завершённых задач коллекции по сроку хранения retention.
+// Ожидающие задачи не затрагиваются, у них ExpireAt не бывает.
+func (m *DB) applyRetention(ctx context.Context, coll *mongo.Collection, retention func(qType, status string) time.Duration) error {
+	for _, status := range terminalStatuses {
+		var qTypes []string
+		if err := coll.Distinct(ctx, "Type", bson.M{"Statuses.0.Status": status}).Decode(&qTypes); err != nil {
+			return err
+		}
+
+		for _, qType := range qTypes {
+			filter := bson.M{"Type": qType, "Statuses.0.Status": status}
+			var update interface{}
+			if d := retention(qType, status); d < 0 {
+				filter["ExpireAt"] = bson.M{"$exists": true}
+				update = bson.M{"$unset": bson.M{"ExpireAt": ""}}
+			} else {
+				update = bson.A{bson.M{"$set": bson.M{"ExpireAt": bson.M{"$add": bson.A{
+					bson.M{"$arrayElemAt": bson.A{"$Statuses.Timestamp", 0}},
+					d.Milliseconds(),
+				}}}}}
+			}
+
+			res, err := coll.UpdateMany(ctx, filter, update)
+			if err != nil {
+				return fmt.Errorf("failed to apply retention to %s %s tasks: %w", status, qType, err)
+			}
+			if res.ModifiedCount > 0 {
+				slog.InfoContext(ctx, "applied retention policy", slog.String("collection", coll.Name()),
+					slog.String("queue_type", qType), slog.String("status", status), slog.Int64("count", res.ModifiedCount))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"testing"
+	"time"
+)
+
+const retentionConfig = `
+queue:
+  retention:
+    processed: 1h
+    failed: -1s
+  types:
+    Reports:
+      retention:
+        processed: 10m
+        cancelled: 48h
+    audit:
+      retention:
+        processed: -1s
+`
+
+func TestRetention(t *testing.T) {
+	s := settingsFrom(t, retentionConfig)
+	tests := []struct {
+		name   string
+		qType  string
+		status string
+		want   time.Duration
+	}{
+		{name: "type override", qType: "Reports", status: "Processed", want: 10 * time.Minute},
+		{name: "type key is case insensitive", qType: "reports", status: "Processed", want: 10 * time.Minute},
+		{name: "type override of other status", qType: "Reports", status: "Cancelled", want: 48 * time.Hour},
+		{name: "falls back to queue level", qType: "Reports", status: "Failed", want: -time.Second},
+		{name: "queue level", qType: "emails", status: "Processed", want: time.Hour},
+		{name: "type keeps forever", qType: "audit", status: "Processed", want: -time.Second},
+		{name: "default", qType: "emails", status: "Expired", want: defaultRetention},
+		{name: "unknown status", qType: "emails", status: "Enqueued", want: defaultRetention},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.retention(tt.qType, tt.status); got != tt.want {
+				t.Errorf("retention(%q, %q) = %v, want %v", tt.qType, tt.status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionUpdate(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		qType  string
+		status string
+		update bson.M
+		want   *time.Time
+	}{
+		{name: "sets expire at", qType: "Reports", status: "Processed", update: bson.M{}, want: ptr(now.Add(10 * time.Minute))},
+		{
+			name:   "keeps other fields",
+			qType:  "emails",
+			status: "Processed",
+			update: bson.M{"$set": bson.M{"Result": bson.M{"ok": true}}},
+			want:   ptr(now.Add(time.Hour)),
+		},
+		{name: "keep forever", qType: "emails", status: "Failed", update: bson.M{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &DB{}
+			m.settings.Store(settingsFrom(t, retentionConfig))
+			before := len(tt.update)
+			_, hadSet := tt.update["$set"]
+
+			m.retentionUpdate(tt.update, tt.qType, tt.status, now)
+
+			set, _ := tt.update["$set"].(bson.M)
+			if tt.want == nil {
+				if len(tt.update) != before {
+					t.Errorf("retentionUpdate() = %v, want update unchanged", tt.update)
+				}
+				return
+			}
+			if got, ok := set["ExpireAt"].(time.Time); !ok || !got.Equal(*tt.want) {
+				t.Errorf("ExpireAt = %v, want %v", set["ExpireAt"], *tt.want)
+			}
+			if hadSet && set["Result"] == nil {
+				t.Errorf("retentionUpdate() dropped existing $set fields: %v", set)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
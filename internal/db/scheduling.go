@@ -0,0 +1,147 @@
+package db
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Стратегии выбора типа очереди, когда обработчик ждёт задачи нескольких типов
+const (
+	// SchedulingStrict строгий приоритет: самая приоритетная и старая задача среди всех типов
+	SchedulingStrict = "strict"
+	// SchedulingWeightedRoundRobin типы по очереди пропорционально весам
+	SchedulingWeightedRoundRobin = "weighted_round_robin"
+	// SchedulingRandomWeighted случайный тип с вероятностью, пропорциональной весу
+	SchedulingRandomWeighted = "random_weighted"
+)
+
+// SchedulingStrategies все поддерживаемые стратегии
+var SchedulingStrategies = []string{SchedulingStrict, SchedulingWeightedRoundRobin, SchedulingRandomWeighted}
+
+// maxSchedulerStates для скольких наборов типов хранится состояние round-robin. Наборы задают клиенты,
+// поэтому при переполнении забывается набор, который дольше всех не запрашивали.
+const maxSchedulerStates = 1024
+
+// scheduler хранит состояние взвешенного round-robin. Состояние своё у каждого инстанса,
+// поэтому между инстансами распределение соблюдается приблизительно.
+type scheduler struct {
+	mu     sync.Mutex
+	states map[string]*roundRobinState
+	tick   uint64
+}
+
+// roundRobinState текущие веса типов одного набора и когда набор запрашивали последний раз
+type roundRobinState struct {
+	current map[string]int
+	used    uint64
+}
+
+// weight вес типа очереди, по умолчанию 1
+func (s *settings) weight(qType string) int {
+	if w := s.typeConfig(qType).Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// schedule возвращает, в каком порядке пробовать типы очереди. Каждый элемент - набор типов,
+// задачи из которого выбираются одним запросом по приоритету и времени добавления.
+func (m *DB) schedule(p DequeueParams, qTypes []string, s *settings) [][]string {
+	strategy := p.Scheduling
+	if strategy == "" {
+		strategy = s.Queue.Scheduling
+	}
+	if len(qTypes) < 2 {
+		strategy = SchedulingStrict
+	}
+
+	var order []string
+	switch strategy {
+	case SchedulingWeightedRoundRobin:
+		order = m.sched.roundRobin(p.Namespace, qTypes, s)
+	case SchedulingRandomWeighted:
+		order = randomWeighted(qTypes, s)
+	default:
+		return [][]string{qTypes}
+	}
+
+	res := make([][]string, 0, len(order))
+	for _, t := range order {
+		res = append(res, []string{t})
+	}
+	return res
+}
+
+// roundRobin выбирает тип плавным взвешенным round-robin (как в nginx), остальные типы идут следом
+// как запасные, если у выбранного нет задач
+func (sc *scheduler) roundRobin(namespace string, qTypes []string, s *settings) []string {
+	sorted := slices.Clone(qTypes)
+	slices.Sort(sorted)
+	key := namespace + "\x00" + strings.Join(sorted, "\x00")
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.states == nil {
+		sc.states = make(map[string]*roundRobinState)
+	}
+	state := sc.states[key]
+	if state == nil {
+		if len(sc.states) >= maxSchedulerStates {
+			sc.evict()
+		}
+		state = &roundRobinState{current: make(map[string]int, len(sorted))}
+		sc.states[key] = state
+	}
+	sc.tick++
+	state.used = sc.tick
+	current := state.current
+
+	total := 0
+	for _, t := range sorted {
+		w := s.weight(t)
+		current[t] += w
+		total += w
+	}
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return current[b] - current[a]
+	})
+	current[sorted[0]] -= total
+	return sorted
+}
+
+// evict забывает набор типов, который дольше всех не запрашивали
+func (sc *scheduler) evict() {
+	var (
+		oldest string
+		used   uint64
+	)
+	for key, state := range sc.states {
+		if oldest == "" || state.used < used {
+			oldest, used = key, state.used
+		}
+	}
+	delete(sc.states, oldest)
+}
+
+// randomWeighted перемешивает типы так, что тип с большим весом с большей вероятностью окажется первым
+func randomWeighted(qTypes []string, s *settings) []string {
+	rest := slices.Clone(qTypes)
+	order := make([]string, 0, len(rest))
+	for len(rest) > 0 {
+		total := 0
+		for _, t := range rest {
+			total += s.weight(t)
+		}
+		n := rand.IntN(total)
+		for i, t := range rest {
+			if n -= s.weight(t); n < 0 {
+				order = append(order, t)
+				rest = slices.Delete(rest, i, i+1)
+				break
+			}
+		}
+	}
+	return order
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// settingsFrom разбирает настройки из YAML так же, как Configure
+func settingsFrom(t *testing.T, yaml string) *settings {
+	t.Helper()
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	var s settings
+	if err := cfg.Unmarshal(&s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+const weightsConfig = `
+queue:
+  types:
+    Emails:
+      weight: 5
+    reports:
+      weight: 2
+    zero:
+      weight: 0
+`
+
+func TestRoundRobin(t *testing.T) {
+	s := settingsFrom(t, weightsConfig)
+	tests := []struct {
+		name   string
+		qTypes []string
+		picks  int
+		want   []string // первые типы по порядку выдачи
+	}{
+		{
+			name:   "smooth weighted",
+			qTypes: []string{"Emails", "billing", "other"},
+			picks:  7,
+			want:   []string{"Emails", "Emails", "billing", "Emails", "other", "Emails", "Emails"},
+		},
+		{
+			name:   "equal weights alternate",
+			qTypes: []string{"b", "a"},
+			picks:  4,
+			want:   []string{"a", "b", "a", "b"},
+		},
+		{
+			name:   "zero weight counts as one",
+			qTypes: []string{"zero", "reports"},
+			picks:  3,
+			want:   []string{"reports", "zero", "reports"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sc scheduler
+			var got []string
+			for range tt.picks {
+				order := sc.roundRobin("default", tt.qTypes, s)
+				if !sameElements(order, tt.qTypes) {
+					t.Fatalf("roundRobin() = %q, want a permutation of %q", order, tt.qTypes)
+				}
+				got = append(got, order[0])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("roundRobin() picks = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinStateIsPerTypeSet(t *testing.T) {
+	s := settingsFrom(t, weightsConfig)
+	var sc scheduler
+	first := func(namespace string, qTypes ...string) string {
+		return sc.roundRobin(namespace, qTypes, s)[0]
+	}
+
+	if got := first("default", "a", "b"); got != "a" {
+		t.Fatalf("first pick = %q, want a", got)
+	}
+	// другое пространство имён и другой порядок того же набора типов
+	if got := first("tenant", "a", "b"); got != "a" {
+		t.Errorf("other namespace pick = %q, want a", got)
+	}
+	if got := first("default", "b", "a"); got != "b" {
+		t.Errorf("same set in other order pick = %q, want b", got)
+	}
+	if got := first("default", "a", "b", "c"); got != "a" {
+		t.Errorf("other set pick = %q, want a", got)
+	}
+}
+
+func TestRoundRobinStateIsBounded(t *testing.T) {
+	s := settingsFrom(t, weightsConfig)
+	var sc scheduler
+	sc.roundRobin("default", []string{"a", "b"}, s)
+	for i := range 2 * maxSchedulerStates {
+		sc.roundRobin("default", []string{"a", fmt.Sprint("type", i)}, s)
+		// часто запрашиваемый набор не вытесняется
+		if i%100 == 0 {
+			sc.roundRobin("default", []string{"a", "b"}, s)
+		}
+	}
+	if got := len(sc.states); got > maxSchedulerStates {
+		t.Errorf("len(states) = %d, want at most %d", got, maxSchedulerStates)
+	}
+	if _, ok := sc.states["default\x00a\x00b"]; !ok {
+		t.Error("state of recently used type set was evicted")
+	}
+	if _, ok := sc.states["default\x00a\x00type0"]; ok {
+		t.Error("state of least recently used type set was kept")
+	}
+}
+
+func TestRandomWeighted(t *testing.T) {
+	s := settingsFrom(t, weightsConfig)
+	tests := []struct {
+		name   string
+		qTypes []string
+		want   map[string]float64 // доля случаев, когда тип первый
+	}{
+		{
+			name:   "proportional to weight",
+			qTypes: []string{"Emails", "reports", "billing"},
+			want:   map[string]float64{"Emails": 5.0 / 8, "reports": 2.0 / 8, "billing": 1.0 / 8},
+		},
+		{
+			name:   "equal weights",
+			qTypes: []string{"a", "b"},
+			want:   map[string]float64{"a": 0.5, "b": 0.5},
+		},
+		{
+			name:   "single type",
+			qTypes: []string{"a"},
+			want:   map[string]float64{"a": 1},
+		},
+	}
+	const trials = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := make(map[string]int)
+			for range trials {
+				order := randomWeighted(tt.qTypes, s)
+				if !sameElements(order, tt.qTypes) {
+					t.Fatalf("randomWeighted() = %q, want a permutation of %q", order, tt.qTypes)
+				}
+				counts[order[0]]++
+			}
+			for qType, want := range tt.want {
+				if got := float64(counts[qType]) / trials; got < want-0.03 || got > want+0.03 {
+					t.Errorf("%s is first in %.3f of cases, want %.3f", qType, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s := settingsFrom(t, "queue:\n  scheduling: weighted_round_robin\n")
+	tests := []struct {
+		name       string
+		scheduling string
+		qTypes     []string
+		wantGroups int
+	}{
+		{name: "configured default", qTypes: []string{"a", "b"}, wantGroups: 2},
+		{name: "strict requested", scheduling: SchedulingStrict, qTypes: []string{"a", "b"}, wantGroups: 1},
+		{name: "random requested", scheduling: SchedulingRandomWeighted, qTypes: []string{"a", "b", "c"}, wantGroups: 3},
+		{name: "single type is strict", qTypes: []string{"a"}, wantGroups: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &DB{}
+			groups := m.schedule(DequeueParams{Scheduling: tt.scheduling}, tt.qTypes, s)
+			if len(groups) != tt.wantGroups {
+				t.Fatalf("schedule() = %q, want %d groups", groups, tt.wantGroups)
+			}
+			var all []string
+			for _, g := range groups {
+				all = append(all, g...)
+			}
+			if !sameElements(all, tt.qTypes) {
+				t.Errorf("schedule() = %q, want all of %q", groups, tt.qTypes)
+			}
+		})
+	}
+}
+
+func sameElements(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/metrics"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"log/slog"
+	"time"
+)
+
+// Depth количество задач одного типа в одном статусе внутри пространства имён
+type Depth struct {
+	Namespace string `bson:"Namespace"`
+	QueueType string `bson:"QueueType"`
+	Status    string `bson:"Status"`
+	Count     int64  `bson:"Count"`
+}
+
+// Depth возвращает количество задач в базе, сгруппированное по пространству имён, типу очереди и текущему статусу
+func (m *DB) Depth(ctx context.Context) (_ []Depth, err error) {
+	ctx, span := startSpan(ctx, "queue", "aggregate")
+	defer func() { endSpan(span, err) }()
+
+	pipeline := bson.A{
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"Namespace": "$Namespace",
+				"QueueType": "$Type",
+				"Status":    bson.M{"$arrayElemAt": bson.A{"$Statuses.Status", 0}},
+			},
+			"Count": bson.M{"$sum": 1},
+		}},
+		bson.M{"$project": bson.M{
+			"_id":       0,
+			"Namespace": "$_id.Namespace",
+			"QueueType": "$_id.QueueType",
+			"Status":    "$_id.Status",
+			"Count":     1,
+		}},
+	}
+
+	cursor, err := m.queue.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate queue depth: %w", err)
+	}
+
+	var result []Depth
+	if err = cursor.All(ctx, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode queue depth: %w", err)
+	}
+	return result, nil
+}
+
+// SampleDepth периодически обновляет метрику глубины очередей, пока не отменён контекст
+func (m *DB) SampleDepth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		depth, err := m.Depth(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to sample queue depth", slog.Any("error", err))
+		} else {
+			metrics.Depth.Reset()
+			for _, d := range depth {
+				metrics.Depth.WithLabelValues(d.Namespace, d.QueueType, d.Status).Set(float64(d.Count))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
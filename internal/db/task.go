@@ -0,0 +1,111 @@
+package db
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"time"
+)
+
+var (
+	// ErrTaskNotFound задачи нет ни в очереди, ни в архиве
+	ErrTaskNotFound = errors.New("task not found")
+	// ErrResultTooLarge результат выполнения задачи больше допустимого
+	ErrResultTooLarge = errors.New("task result is too large")
+)
+
+// Status запись в истории статусов задачи (последний статус всегда первый в списке)
+type Status struct {
+	Status           string     `bson:"Status" json:"status"`
+	Timestamp        time.Time  `bson:"Timestamp" json:"timestamp"`
+	NextReevaluation *time.Time `bson:"NextReevaluation,omitempty" json:"next_reevaluation,omitempty"`
+	Message          string     `bson:"Message,omitempty" json:"message,omitempty"`
+	// LeaseUntil до какого момента обработчик должен завершить задачу (только для Processing)
+	LeaseUntil *time.Time `bson:"LeaseUntil,omitempty" json:"lease_until,omitempty"`
+	// LeaseID идентификатор выдачи, по которому обработчик подтверждает, что задача всё ещё у него
+	LeaseID string `bson:"LeaseID,omitempty" json:"-"`
+}
+
+// CompletedDependency выполненная задача, от которой зависит другая задача
+type CompletedDependency struct {
+	ID bson.ObjectID `bson:"ID"`
+	// Collected результат родителя попадает в Payload.results (только для задач той же группы)
+	Collected bool                   `bson:"Collected,omitempty"`
+	Result    map[string]interface{} `bson:"Result,omitempty"`
+}
+
+// Task задача в том виде, в котором она хранится в коллекциях queue и queue_history
+type Task struct {
+	ID        bson.ObjectID          `bson:"_id" json:"id"`
+	Namespace string                 `bson:"Namespace" json:"namespace"`
+	Type      string                 `bson:"Type" json:"queue_type"`
+	Priority  int                    `bson:"Priority" json:"priority"`
+	Payload   map[string]interface{} `bson:"Payload" json:"payload"`
+	Statuses  []Status               `bson:"Statuses" json:"statuses"`
+
+	// EffectivePriority приоритет с учётом времени ожидания, по нему задачи выбираются и сортируются
+	EffectivePriority int `bson:"EffectivePriority" json:"effective_priority"`
+
+	PayloadSize int64 `bson:"PayloadSize,omitempty" json:"payload_size,omitempty"`
+
+	// GroupKey задачи одной группы обрабатываются по одной в порядке добавления
+	GroupKey string `bson:"GroupKey,omitempty" json:"group_key,omitempty"`
+
+	// DependsOn задачи, которые должны быть выполнены до этой. Пока они не выполнены, задача в статусе Blocked.
+	DependsOn []bson.ObjectID `bson:"DependsOn,omitempty" json:"depends_on,omitempty"`
+
+	// CompletedDependencies задачи из DependsOn, которые уже выполнены, вместе с результатами (если CollectResults).
+	// Запоминаются в момент выполнения, чтобы их не потерять, если родителя удалят по сроку хранения раньше.
+	CompletedDependencies []CompletedDependency `bson:"CompletedDependencies,omitempty" json:"-"`
+
+	// CollectResults при разблокировке результаты задач из DependsOn той же группы добавляются в Payload.results
+	CollectResults bool `bson:"CollectResults,omitempty" json:"collect_results,omitempty"`
+
+	// BatchID группа задач, в которую входит задача
+	BatchID *bson.ObjectID `bson:"BatchID,omitempty" json:"batch_id,omitempty"`
+
+	// ExpiresAt после этого момента задача не выдаётся обработчикам и переходит в статус Expired
+	ExpiresAt *time.Time `bson:"ExpiresAt,omitempty" json:"expires_at,omitempty"`
+
+	// DeadLetter заполнено у задач, попавших в очередь недоставленных
+	DeadLetter *DeadLetter `bson:"DeadLetter,omitempty" json:"dead_letter,omitempty"`
+
+	// Slots слоты конкурентности и блокировка группы, которые занимает задача в статусе Processing
+	Slots []SlotID `bson:"Slots,omitempty" json:"-"`
+
+	// Progress ход выполнения, о котором сообщил обработчик
+	Progress *Progress `bson:"Progress,omitempty" json:"progress,omitempty"`
+
+	// Result результат выполнения, переданный обработчиком при подтверждении
+	Result map[string]interface{} `bson:"Result,omitempty" json:"result,omitempty"`
+
+	// ExpireAt когда завершённая задача будет удалена
+	ExpireAt *time.Time `bson:"ExpireAt,omitempty" json:"expire_at,omitempty"`
+	// ArchivedAt когда задача перенесена в архив
+	ArchivedAt *time.Time `bson:"ArchivedAt,omitempty" json:"archived_at,omitempty"`
+
+	// PendingEvents события жизненного цикла, ещё не перенесённые в outbox
+	PendingEvents []Event `bson:"PendingEvents,omitempty" json:"-"`
+
+	// W3C trace context запроса, которым задача была добавлена
+	TraceParent string `bson:"TraceParent,omitempty" json:"-"`
+	TraceState  string `bson:"TraceState,omitempty" json:"-"`
+}
+
+// Current возвращает текущий статус задачи
+func (t *Task) Current() Status {
+	if len(t.Statuses) == 0 {
+		return Status{}
+	}
+	return t.Statuses[0]
+}
+
+// Attempts сколько раз задача выдавалась обработчикам, включая текущую выдачу
+func (t *Task) Attempts() int {
+	n := 0
+	for _, s := range t.Statuses {
+		if s.Status == "Processing" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/auth"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"strings"
+)
+
+// DefaultNamespace пространство имён для задач и клиентов, у которых оно не задано
+const DefaultNamespace = auth.DefaultNamespace
+
+// ErrQuotaExceeded у пространства имён закончилась квота на задачи или объём данных
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+// Quota ограничения пространства имён на незавершённые (Enqueued и Processing) задачи. 0 - без ограничений.
+type Quota struct {
+	MaxPending      int64 `mapstructure:"max_pending"`
+	MaxPayloadBytes int64 `mapstructure:"max_payload_bytes"`
+}
+
+type tenantsConfig struct {
+	DefaultQuota Quota            `mapstructure:"default_quota"`
+	Quotas       map[string]Quota `mapstructure:"quotas"`
+}
+
+// quota квота пространства имён. Ключи в конфиге viper приводит к нижнему регистру.
+func (c tenantsConfig) quota(namespace string) Quota {
+	if q, ok := c.Quotas[strings.ToLower(namespace)]; ok {
+		return q
+	}
+	return c.DefaultQuota
+}
+
+var pendingStatuses = bson.A{"Enqueued", "Processing", "Blocked"}
+
+// NamespaceUsage занятая пространством имён часть квоты
+type NamespaceUsage struct {
+	Pending      int64 `bson:"Pending"`
+	PayloadBytes int64 `bson:"PayloadBytes"`
+}
+
+// Usage возвращает количество и объём незавершённых задач пространства имён
+func (m *DB) Usage(ctx context.Context, namespace string) (_ NamespaceUsage, err error) {
+	ctx, span := startSpan(ctx, "queue", "aggregate")
+	defer func() { endSpan(span, err) }()
+
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"Namespace": namespace, "Statuses.0.Status": bson.M{"$in": pendingStatuses}}},
+		bson.M{"$group": bson.M{
+			"_id":          nil,
+			"Pending":      bson.M{"$sum": 1},
+			"PayloadBytes": bson.M{"$sum": "$PayloadSize"},
+		}},
+	}
+	cursor, err := m.queue.Aggregate(ctx, pipeline)
+	if err != nil {
+		return NamespaceUsage{}, fmt.Errorf("failed to aggregate namespace usage: %w", err)
+	}
+	var result []NamespaceUsage
+	if err = cursor.All(ctx, &result); err != nil {
+		return NamespaceUsage{}, fmt.Errorf("failed to decode namespace usage: %w", err)
+	}
+	if len(result) == 0 {
+		return NamespaceUsage{}, nil
+	}
+	return result[0], nil
+}
+
+// checkQuota проверяет, что новая задача размером payloadSize поместится в квоту.
+// Проверка не атомарна со вставкой, поэтому при параллельной записи квота может быть немного превышена.
+func (m *DB) checkQuota(ctx context.Context, namespace string, payloadSize int64) error {
+	quota := m.config().Tenants.quota(namespace)
+	if quota.MaxPending <= 0 && quota.MaxPayloadBytes <= 0 {
+		return nil
+	}
+
+	u, err := m.Usage(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	if quota.MaxPending > 0 && u.Pending+1 > quota.MaxPending {
+		return fmt.Errorf("%w: %d of %d pending tasks", ErrQuotaExceeded, u.Pending, quota.MaxPending)
+	}
+	if quota.MaxPayloadBytes > 0 && u.PayloadBytes+payloadSize > quota.MaxPayloadBytes {
+		return fmt.Errorf("%w: %d of %d payload bytes", ErrQuotaExceeded, u.PayloadBytes, quota.MaxPayloadBytes)
+	}
+	return nil
+}
+
+// payloadSize размер данных задачи в BSON
+func payloadSize(payload map[string]interface{}) (int64, error) {
+	b, err := bson.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return int64(len(b)), nil
+}
@@ -0,0 +1,35 @@
+package db
+
+import "testing"
+
+func TestTenantsQuota(t *testing.T) {
+	s := settingsFrom(t, `
+tenants:
+  default_quota:
+    max_pending: 100
+  quotas:
+    Acme:
+      max_pending: 10
+      max_payload_bytes: 1024
+    billing:
+      max_pending: 5
+`)
+	tests := []struct {
+		namespace string
+		want      Quota
+	}{
+		{namespace: "Acme", want: Quota{MaxPending: 10, MaxPayloadBytes: 1024}},
+		{namespace: "acme", want: Quota{MaxPending: 10, MaxPayloadBytes: 1024}},
+		{namespace: "BILLING", want: Quota{MaxPending: 5}},
+		{namespace: "billing", want: Quota{MaxPending: 5}},
+		{namespace: "other", want: Quota{MaxPending: 100}},
+		{namespace: DefaultNamespace, want: Quota{MaxPending: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			if got := s.Tenants.quota(tt.namespace); got != tt.want {
+				t.Errorf("quota(%q) = %+v, want %+v", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/morzik45/go-queue/internal/db")
+
+// startSpan открывает спан для операции с коллекцией
+func startSpan(ctx context.Context, collection, operation string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "mongodb."+collection+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemMongoDB,
+			semconv.DBCollectionName(collection),
+			semconv.DBOperationName(operation),
+		),
+	)
+}
+
+// endSpan закрывает спан, помечая его ошибкой при необходимости
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext сохраняет контекст трассировки продюсера в документ задачи
+func injectTraceContext(ctx context.Context, doc map[string]interface{}) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if tp := carrier.Get("traceparent"); tp != "" {
+		doc["TraceParent"] = tp
+		if ts := carrier.Get("tracestate"); ts != "" {
+			doc["TraceState"] = ts
+		}
+	}
+}
+
+// producerSpanContext восстанавливает контекст трассировки продюсера из задачи
+func producerSpanContext(t *Task) trace.SpanContext {
+	if t.TraceParent == "" {
+		return trace.SpanContext{}
+	}
+	carrier := propagation.MapCarrier{"traceparent": t.TraceParent}
+	if t.TraceState != "" {
+		carrier["tracestate"] = t.TraceState
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), carrier)
+	return trace.SpanContextFromContext(ctx)
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "goqueue"
+
+var (
+	// Enqueued количество добавленных задач по пространствам имён и типам очередей
+	Enqueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_enqueued_total",
+		Help:      "Total number of enqueued tasks.",
+	}, []string{"namespace", "queue_type"})
+
+	// Dequeued количество выданных обработчикам задач
+	Dequeued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_dequeued_total",
+		Help:      "Total number of dequeued tasks.",
+	}, []string{"namespace", "queue_type"})
+
+	// Acked количество успешно обработанных задач
+	Acked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_acked_total",
+		Help:      "Total number of acknowledged tasks.",
+	}, []string{"namespace", "queue_type"})
+
+	// Failed количество задач, помеченных как невыполненные
+	Failed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_failed_total",
+		Help:      "Total number of failed tasks.",
+	}, []string{"namespace", "queue_type"})
+
+	// LeasesExpired количество задач, возвращённых в очередь по истечении аренды
+	LeasesExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "leases_expired_total",
+		Help:      "Total number of tasks returned to the queue after their lease expired.",
+	}, []string{"namespace", "queue_type"})
+
+	// Expired количество задач, срок жизни которых истёк до выдачи обработчику
+	Expired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_expired_total",
+		Help:      "Total number of tasks that expired before being dequeued.",
+	}, []string{"namespace", "queue_type"})
+
+	// PushDeliveries количество отправок задач на HTTP-адреса очередей по результату (success, failure, error)
+	PushDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_deliveries_total",
+		Help:      "Total number of push deliveries by result.",
+	}, []string{"namespace", "queue_type", "result"})
+
+	// EventDeliveries количество отправок событий жизненного цикла подписчикам по результату (success, failure)
+	EventDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_deliveries_total",
+		Help:      "Total number of lifecycle event deliveries by result.",
+	}, []string{"subscription", "event", "result"})
+
+	// HTTPDuration время обработки http запросов
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests handled by the server.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// WaitTime время от постановки задачи в очередь до её выдачи обработчику
+	WaitTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_wait_seconds",
+		Help:      "Time a task spent in the queue before it was dequeued.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"namespace", "queue_type"})
+
+	// ProcessingTime время от выдачи задачи до подтверждения её выполнения
+	ProcessingTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_processing_seconds",
+		Help:      "Time between dequeue and ack of a task.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"namespace", "queue_type"})
+
+	// Waiters количество обработчиков, ожидающих задачи (long polling)
+	Waiters = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "waiters",
+		Help:      "Number of consumers currently waiting for a task.",
+	})
+
+	// Depth количество задач в базе по пространствам имён, типам очередей и статусам
+	Depth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of tasks in the queue by namespace, type and current status (sampled periodically).",
+	}, []string{"namespace", "queue_type", "status"})
+)
@@ -0,0 +1,68 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/morzik45/go-queue/internal/metrics"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// dispatchEvents забирает из outbox события подписок, пока у их адресатов есть свободные места
+func (p *Pusher) dispatchEvents(ctx context.Context) {
+	for _, sub := range p.store.EventSubscriptions() {
+		if sub.Name == "" || sub.URL == "" {
+			continue
+		}
+		for p.acquire(sub.URL, sub.Concurrency) {
+			event, err := p.store.ClaimEvent(ctx, sub.Name, sub.Timeout+leaseMargin)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to claim event", slog.String("subscription", sub.Name), slog.Any("error", err))
+			}
+			if event == nil {
+				p.release(sub.URL)
+				break
+			}
+
+			p.wg.Add(1)
+			go p.deliverEvent(ctx, sub, event)
+		}
+	}
+}
+
+// deliverEvent отправляет событие подписчику и удаляет его из outbox либо откладывает повтор
+func (p *Pusher) deliverEvent(ctx context.Context, sub db.EventSubscription, event *db.Event) {
+	defer p.wg.Done()
+	defer p.free(sub.URL)
+
+	body, err := json.Marshal(event)
+	if err == nil {
+		header := make(http.Header)
+		header.Set("X-Queue-Event", event.Event)
+		header.Set("X-Queue-Event-Id", event.ID.Hex())
+		_, err = p.post(ctx, sub.PushConfig, body, header)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Сервер останавливается - событие будет отправлено после истечения аренды
+		return
+	}
+
+	dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err != nil {
+		metrics.EventDeliveries.WithLabelValues(sub.Name, event.Event, "failure").Inc()
+		slog.WarnContext(dbCtx, "event delivery failed", slog.String("subscription", sub.Name),
+			slog.String("event", event.Event), slog.String("id", event.TaskID), slog.Int("attempt", event.Attempts), slog.Any("error", err))
+		if err = p.store.EventFailed(dbCtx, event, sub, err.Error()); err != nil {
+			slog.ErrorContext(dbCtx, "failed to reschedule event", slog.String("subscription", sub.Name), slog.Any("error", err))
+		}
+		return
+	}
+
+	metrics.EventDeliveries.WithLabelValues(sub.Name, event.Event, "success").Inc()
+	if err = p.store.EventDelivered(dbCtx, event.ID); err != nil {
+		slog.ErrorContext(dbCtx, "failed to remove delivered event", slog.String("subscription", sub.Name), slog.Any("error", err))
+	}
+}
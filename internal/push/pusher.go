@@ -0,0 +1,240 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/morzik45/go-queue/internal/metrics"
+	"github.com/morzik45/go-queue/pkg/utils"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// dispatchInterval как часто проверяются очереди, если ни одна отправка не завершилась
+	dispatchInterval = time.Second
+	// leaseMargin запас аренды сверх таймаута запроса, чтобы успеть сохранить результат
+	leaseMargin = 30 * time.Second
+	// maxResponseBytes сколько читается из ответа адресата
+	maxResponseBytes = 1 << 20
+)
+
+// Pusher выдаёт задачи очередей с настроенным push.url и отправляет их POST-запросом, а также
+// доставляет подписчикам события жизненного цикла задач. Одновременно на один URL отправляется
+// не больше concurrency запросов.
+type Pusher struct {
+	store  *db.DB
+	client *http.Client
+
+	mu       sync.Mutex
+	inFlight map[string]int
+	freed    chan struct{}
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+func New(store *db.DB) *Pusher {
+	return &Pusher{
+		store:    store,
+		client:   &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		inFlight: make(map[string]int),
+		freed:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Run отправляет задачи, пока не отменён ctx, и дожидается завершения начатых отправок
+func (p *Pusher) Run(ctx context.Context) {
+	defer close(p.done)
+	defer p.wg.Wait()
+
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		// При остановке сервера новые задачи не выдаются, как и обработчикам на /dequeue
+		if !p.store.Waiters.Draining() {
+			p.dispatch(ctx, p.store.PushQueues())
+		}
+		p.dispatchEvents(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.freed:
+		case <-p.store.EventsReady():
+		}
+	}
+}
+
+// Done закрывается, когда все начатые отправки завершены
+func (p *Pusher) Done() <-chan struct{} {
+	return p.done
+}
+
+// dispatch выдаёт задачи, пока у адресатов есть свободные места
+func (p *Pusher) dispatch(ctx context.Context, queues []db.PushQueue) {
+	for _, q := range queues {
+		for p.acquire(q.Push.URL, q.Push.Concurrency) {
+			task, err := p.store.Dequeue(ctx, db.DequeueParams{
+				Namespace: q.Namespace,
+				Types:     []string{q.Type},
+				Lease:     q.Push.Timeout + leaseMargin,
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "push dequeue error", slog.String("queue_type", q.Type), slog.Any("error", err))
+			}
+			if task == nil {
+				p.release(q.Push.URL)
+				break
+			}
+
+			p.wg.Add(1)
+			go p.deliver(ctx, q, task)
+		}
+	}
+}
+
+func (p *Pusher) acquire(url string, limit int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inFlight[url] >= limit {
+		return false
+	}
+	p.inFlight[url]++
+	return true
+}
+
+func (p *Pusher) release(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inFlight[url]--; p.inFlight[url] <= 0 {
+		delete(p.inFlight, url)
+	}
+}
+
+// free освобождает место адресата после отправки и будит цикл выдачи
+func (p *Pusher) free(url string) {
+	p.release(url)
+	select {
+	case p.freed <- struct{}{}:
+	default:
+	}
+}
+
+// deliver отправляет задачу и подтверждает её, возвращает в очередь или отмечает неудачу по ответу адресата
+func (p *Pusher) deliver(ctx context.Context, q db.PushQueue, task map[string]interface{}) {
+	defer p.wg.Done()
+	defer p.free(q.Push.URL)
+
+	id, _ := task["id"].(string)
+	leaseID, _ := task["lease_id"].(string)
+	attempt, _ := task["attempt"].(int)
+	result, err := p.send(ctx, q.Push, task)
+
+	// Результат нужно сохранить, даже если сервер останавливается
+	dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// Отправку прервала остановка сервера, а не адресат - задача будет отправлена заново
+		if err = p.store.Release(dbCtx, id, leaseID); err != nil {
+			slog.ErrorContext(dbCtx, "failed to release push task", slog.String("id", id), slog.Any("error", err))
+		}
+	case err != nil:
+		metrics.PushDeliveries.WithLabelValues(q.Namespace, q.Type, "failure").Inc()
+		if attempt < q.Push.MaxAttempts {
+			delay := max(q.Push.RetryDelayFor(attempt), time.Second)
+			slog.WarnContext(dbCtx, "push delivery failed",
+				slog.String("id", id), slog.Int("attempt", attempt), slog.Duration("retry_in", delay), slog.Any("error", err))
+			if err = p.store.Retry(dbCtx, q.Namespace, id, leaseID, delay, err.Error()); err != nil {
+				slog.ErrorContext(dbCtx, "failed to retry push task", slog.String("id", id), slog.Any("error", err))
+			}
+		} else {
+			slog.WarnContext(dbCtx, "push delivery failed", slog.String("id", id), slog.Int("attempt", attempt), slog.Any("error", err))
+			if err = p.store.Failed(dbCtx, q.Namespace, id, leaseID, 0, err.Error()); err != nil {
+				slog.ErrorContext(dbCtx, "failed to fail push task", slog.String("id", id), slog.Any("error", err))
+			}
+		}
+	default:
+		metrics.PushDeliveries.WithLabelValues(q.Namespace, q.Type, "success").Inc()
+		err = p.store.Ack(dbCtx, q.Namespace, id, leaseID, result)
+		if errors.Is(err, db.ErrResultTooLarge) {
+			slog.WarnContext(dbCtx, "push response is too large to keep as task result", slog.String("id", id))
+			err = p.store.Ack(dbCtx, q.Namespace, id, leaseID, nil)
+		}
+		if err != nil {
+			metrics.PushDeliveries.WithLabelValues(q.Namespace, q.Type, "error").Inc()
+			slog.ErrorContext(dbCtx, "failed to ack push task", slog.String("id", id), slog.Any("error", err))
+		}
+	}
+}
+
+// send отправляет задачу адресату. Тело ответа 2xx, если это JSON-объект, становится результатом задачи.
+func (p *Pusher) send(ctx context.Context, cfg db.PushConfig, task map[string]interface{}) (map[string]interface{}, error) {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode task: %w", err)
+	}
+	header := make(http.Header)
+	if id, ok := task["id"].(string); ok {
+		header.Set("X-Queue-Task-Id", id)
+	}
+
+	data, err := p.post(ctx, cfg, body, header)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	if json.Unmarshal(data, &result) != nil {
+		result = nil
+	}
+	return result, nil
+}
+
+// post отправляет подписанный запрос и возвращает тело ответа 2xx. Любой другой ответ считается ошибкой.
+func (p *Pusher) post(ctx context.Context, cfg db.PushConfig, body []byte, header http.Header) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Secret != "" {
+		ts := time.Now().Unix()
+		req.Header.Set(utils.TimestampHeader, strconv.FormatInt(ts, 10))
+		req.Header.Set(utils.SignatureHeader, utils.Sign([]byte(cfg.Secret), ts, body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("push target responded with %s", resp.Status)
+	}
+	if err != nil {
+		// запрос обработан, потеряно только тело ответа
+		slog.WarnContext(ctx, "failed to read push response", slog.Any("error", err))
+		return nil, nil
+	}
+	return data, nil
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/morzik45/go-queue/internal/server/handlers"
+	"github.com/spf13/viper"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// defaultMaxBodyBytes максимальный размер тела запроса, если не задан web.max_body_bytes
+const defaultMaxBodyBytes = 4 << 20
+
+// requestTarget поля тела запроса, нужные middleware до того, как его разберёт обработчик
+type requestTarget struct {
+	ApiKey     string   `json:"api_key"`
+	Namespace  string   `json:"namespace"`
+	QueueType  string   `json:"queue_type"`
+	QueueTypes []string `json:"queue_types"`
+
+	// задачи группы и обратный вызов (POST /batches)
+	Tasks    []requestTarget `json:"tasks"`
+	Callback *requestTarget  `json:"callback"`
+}
+
+// queueTypes все типы очередей из запроса без повторов
+func (t requestTarget) queueTypes() []string {
+	var types []string
+	add := func(qTypes ...string) {
+		for _, qType := range qTypes {
+			if qType != "" && !slices.Contains(types, qType) {
+				types = append(types, qType)
+			}
+		}
+	}
+	add(t.QueueType)
+	add(t.QueueTypes...)
+	for _, task := range t.Tasks {
+		add(task.queueTypes()...)
+	}
+	if t.Callback != nil {
+		add(t.Callback.queueTypes()...)
+	}
+	return types
+}
+
+type contextKey string
+
+const targetKey contextKey = "request_target"
+
+func targetFromContext(ctx context.Context) requestTarget {
+	t, _ := ctx.Value(targetKey).(requestTarget)
+	return t
+}
+
+// peekTarget читает тело запроса, запоминает типы очередей и api_key, и возвращает тело на место для обработчика.
+// Тело читается до аутентификации, поэтому его размер ограничен web.max_body_bytes.
+// Ошибки разбора игнорируются - о них сообщит обработчик.
+func peekTarget(cfg *viper.Viper) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				// У запросов без тела (GET /stream) очереди передаются в параметрах
+				target := requestTarget{QueueTypes: handlers.QueryTypes(r)}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), targetKey, target)))
+				return
+			}
+
+			limit := int64(defaultMaxBodyBytes)
+			if n := cfg.GetInt64("web.max_body_bytes"); n > 0 {
+				limit = n
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+			_ = r.Body.Close()
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "failed to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			var target requestTarget
+			_ = json.Unmarshal(body, &target)
+
+			ctx := context.WithValue(r.Context(), targetKey, target)
+			if target.ApiKey != "" {
+				ctx = auth.WithLegacyKey(ctx, target.ApiKey)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authenticate определяет клиента и кладёт его в контекст запроса
+func authenticate(authn auth.Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := authn.Authenticate(r)
+			switch {
+			case errors.Is(err, auth.ErrNoCredentials):
+				writeError(w, http.StatusUnauthorized, "missing credentials")
+				return
+			case errors.Is(err, auth.ErrInvalidCredentials):
+				writeError(w, http.StatusUnauthorized, "invalid credentials")
+				return
+			case err != nil:
+				slog.ErrorContext(r.Context(), "authentication error", slog.Any("error", err))
+				writeError(w, http.StatusInternalServerError, "authentication failed")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// authorize проверяет, что у клиента есть хотя бы одна из операций и доступ к пространству имён и ко всем
+// очередям из запроса. Пространство имён берётся из тела запроса или параметра namespace, а если не указано -
+// используется пространство клиента.
+func authorize(scopes ...auth.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := auth.FromContext(r.Context())
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "missing credentials")
+				return
+			}
+
+			allowed := false
+			for _, scope := range scopes {
+				if identity.HasScope(scope) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("operation is not allowed for %s", identity.Name))
+				return
+			}
+
+			target := targetFromContext(r.Context())
+			namespace := target.Namespace
+			if namespace == "" {
+				namespace = r.URL.Query().Get("namespace")
+			}
+			if namespace == "" {
+				namespace = identity.Namespace
+			}
+			if namespace == "" {
+				namespace = db.DefaultNamespace
+			}
+			if !identity.CanAccessNamespace(namespace) {
+				writeError(w, http.StatusForbidden, "access denied to namespace "+namespace)
+				return
+			}
+
+			var denied []string
+			for _, qType := range target.queueTypes() {
+				if !identity.CanAccessQueue(qType) {
+					denied = append(denied, qType)
+				}
+			}
+			if len(denied) > 0 {
+				writeError(w, http.StatusForbidden, "access denied to queues: "+strings.Join(denied, ", "))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.WithNamespace(r.Context(), namespace)))
+		})
+	}
+}
+
+type errorResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(errorResponse{Message: message}); err != nil {
+		slog.Error("send error response error", slog.Any("error", err))
+	}
+}
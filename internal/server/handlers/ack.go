@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"github.com/morzik45/go-queue/internal/auth"
 	"github.com/morzik45/go-queue/internal/db"
 	"github.com/spf13/viper"
 	"log/slog"
@@ -9,8 +11,11 @@ import (
 )
 
 type AckRequest struct {
-	ApiKey string `json:"api_key"`
-	ID     string `json:"id"`
+	ApiKey    string                 `json:"api_key"`
+	Namespace string                 `json:"namespace,omitempty"`
+	ID        string                 `json:"id"`
+	LeaseID   string                 `json:"lease_id"`
+	Result    map[string]interface{} `json:"result,omitempty"`
 }
 
 func (ar AckRequest) Valid(_ context.Context) map[string]string {
@@ -18,6 +23,9 @@ func (ar AckRequest) Valid(_ context.Context) map[string]string {
 	if ar.ID == "" {
 		problems["id"] = "field id is required"
 	}
+	if ar.LeaseID == "" {
+		problems["lease_id"] = "field lease_id is required"
+	}
 
 	return problems
 }
@@ -28,7 +36,7 @@ type AckResponse struct {
 	Problems map[string]string `json:"problems"`
 }
 
-func Ack(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
+func Ack(store *db.DB, _ *viper.Viper) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resp := AckResponse{}
 		req, problems, err := decodeValid[AckRequest](r)
@@ -44,21 +52,21 @@ func Ack(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 			return
 		}
 
-		isAuth := checkApiKey(req.ApiKey, cfg)
-		if !isAuth {
-			resp.Message = "invalid api key"
-			if err2 := encode(w, r, http.StatusUnauthorized, resp); err2 != nil {
-				slog.Error("enqueue send response error",
-					slog.Any("error", err2),
-					slog.Any("problems", problems),
-					slog.Any("first_error", err))
-			}
-			return
+		ctx := r.Context()
+		if _, err = accessibleTask(ctx, store, req.ID); err == nil {
+			err = store.Ack(ctx, auth.Namespace(ctx), req.ID, req.LeaseID, req.Result)
 		}
-
-		err = store.Ack(r.Context(), req.ID)
 		var status int
-		if err != nil {
+		if errors.Is(err, db.ErrTaskNotFound) {
+			resp.Message = err.Error()
+			status = http.StatusNotFound
+		} else if errors.Is(err, db.ErrTaskNotProcessing) {
+			resp.Message = err.Error()
+			status = http.StatusConflict
+		} else if errors.Is(err, db.ErrResultTooLarge) {
+			resp.Message = err.Error()
+			status = http.StatusRequestEntityTooLarge
+		} else if err != nil {
 			resp.Message = err.Error()
 			status = http.StatusInternalServerError
 		} else {
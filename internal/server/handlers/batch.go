@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+)
+
+// maxBatchSize сколько задач можно добавить одной группой
+const maxBatchSize = 1000
+
+type BatchRequest struct {
+	ApiKey    string           `json:"api_key"`
+	Namespace string           `json:"namespace,omitempty"`
+	Tasks     []EnqueueRequest `json:"tasks"`
+	// Chain задачи выполняются по очереди, каждая получает результат предыдущей в payload.results
+	Chain bool `json:"chain,omitempty"`
+	// Callback ставится в очередь после успешного выполнения всех задач и получает их результаты в payload.results
+	Callback *EnqueueRequest `json:"callback,omitempty"`
+}
+
+func (br BatchRequest) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+	if len(br.Tasks) == 0 {
+		problems["tasks"] = "field tasks is required"
+	}
+	if len(br.Tasks) > maxBatchSize {
+		problems["tasks"] = fmt.Sprintf("field tasks must contain at most %d tasks", maxBatchSize)
+	}
+	for i, task := range br.Tasks {
+		for field, problem := range task.Valid(ctx) {
+			problems[fmt.Sprintf("tasks[%d].%s", i, field)] = problem
+		}
+	}
+	if br.Callback != nil {
+		for field, problem := range br.Callback.Valid(ctx) {
+			problems["callback."+field] = problem
+		}
+	}
+	return problems
+}
+
+type BatchResponse struct {
+	Success  bool              `json:"success"`
+	Message  string            `json:"message,omitempty"`
+	Problems map[string]string `json:"problems,omitempty"`
+	Batch    *db.Batch         `json:"batch,omitempty"`
+}
+
+// CreateBatch добавляет группу задач и задачу обратного вызова, которая выполнится после них
+func CreateBatch(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := BatchResponse{}
+		req, problems, err := decodeValid[BatchRequest](r)
+		if err != nil {
+			resp.Problems = problems
+			resp.Message = err.Error()
+			if err2 := encode(w, r, http.StatusBadRequest, resp); err2 != nil {
+				slog.Error("batch send response error",
+					slog.Any("error", err2),
+					slog.Any("problems", problems),
+					slog.Any("first_error", err))
+			}
+			return
+		}
+
+		namespace := auth.Namespace(r.Context())
+		p := db.BatchParams{
+			Namespace: namespace,
+			Tasks:     make([]db.EnqueueParams, 0, len(req.Tasks)),
+			Chain:     req.Chain,
+		}
+		for _, task := range req.Tasks {
+			p.Tasks = append(p.Tasks, task.params(namespace))
+		}
+		if req.Callback != nil {
+			callback := req.Callback.params(namespace)
+			p.Callback = &callback
+		}
+
+		batch, err := store.CreateBatch(r.Context(), p)
+		var status int
+		switch {
+		case errors.Is(err, db.ErrQuotaExceeded):
+			resp.Message = err.Error()
+			status = http.StatusTooManyRequests
+		case errors.Is(err, db.ErrDependencyNotFound):
+			resp.Message = err.Error()
+			resp.Problems = map[string]string{"depends_on": err.Error()}
+			status = http.StatusBadRequest
+		case err != nil:
+			resp.Message = err.Error()
+			status = http.StatusInternalServerError
+		default:
+			resp.Success = true
+			resp.Batch = batch
+			status = http.StatusCreated
+		}
+		if err = encode(w, r, status, resp); err != nil {
+			slog.Error("batch send response error", slog.Any("error", err))
+		}
+	}
+}
+
+// Batch возвращает группу задач и ход её выполнения
+func Batch(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		batch, err := accessibleBatch(ctx, store, r.PathValue("id"))
+		writeBatch(w, r, batch, err)
+	}
+}
+
+// CancelBatch отменяет задачи группы, которые ещё не выданы обработчикам
+func CancelBatch(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		batch, err := accessibleBatch(ctx, store, r.PathValue("id"))
+		if err == nil {
+			batch, err = store.CancelBatch(ctx, auth.Namespace(ctx), batch.ID.Hex())
+		}
+		writeBatch(w, r, batch, err)
+	}
+}
+
+// accessibleBatch возвращает группу, если у клиента есть доступ ко всем её очередям
+func accessibleBatch(ctx context.Context, store *db.DB, id string) (*db.Batch, error) {
+	batch, err := store.Batch(ctx, auth.Namespace(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	if identity, ok := auth.FromContext(ctx); ok {
+		for _, qType := range batch.Types {
+			if !identity.CanAccessQueue(qType) {
+				return nil, db.ErrBatchNotFound
+			}
+		}
+	}
+	return batch, nil
+}
+
+func writeBatch(w http.ResponseWriter, r *http.Request, batch *db.Batch, err error) {
+	resp := BatchResponse{}
+	var status int
+	switch {
+	case errors.Is(err, db.ErrBatchNotFound):
+		resp.Message = err.Error()
+		status = http.StatusNotFound
+	case err != nil:
+		resp.Message = err.Error()
+		status = http.StatusInternalServerError
+		slog.ErrorContext(r.Context(), "batch lookup error", slog.Any("error", err))
+	default:
+		resp.Success = true
+		resp.Batch = batch
+		status = http.StatusOK
+	}
+	if err = encode(w, r, status, resp); err != nil {
+		slog.ErrorContext(r.Context(), "batch send response error", slog.Any("error", err))
+	}
+}
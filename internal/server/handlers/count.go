@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"github.com/morzik45/go-queue/internal/auth"
 	"github.com/morzik45/go-queue/internal/db"
 	"github.com/spf13/viper"
 	"log/slog"
@@ -10,6 +11,7 @@ import (
 
 type CountRequest struct {
 	ApiKey    string      `json:"api_key"`
+	Namespace string      `json:"namespace,omitempty"`
 	QueueType string      `json:"queue_type"`
 	Key       string      `json:"key"`
 	Value     interface{} `json:"value"`
@@ -37,7 +39,7 @@ type CountResponse struct {
 	Count    int               `json:"count"` // count of items in queue
 }
 
-func Count(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
+func Count(store *db.DB, _ *viper.Viper) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resp := CountResponse{}
 		req, problems, err := decodeValid[CountRequest](r)
@@ -53,20 +55,8 @@ func Count(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 			return
 		}
 
-		isAuth := checkApiKey(req.ApiKey, cfg)
-		if !isAuth {
-			resp.Message = "invalid api key"
-			if err2 := encode(w, r, http.StatusUnauthorized, resp); err2 != nil {
-				slog.Error("enqueue send response error",
-					slog.Any("error", err2),
-					slog.Any("problems", problems),
-					slog.Any("first_error", err))
-			}
-			return
-		}
-
 		var count int64
-		count, err = store.Count(r.Context(), req.QueueType, req.Key, req.Value)
+		count, err = store.Count(r.Context(), auth.Namespace(r.Context()), req.QueueType, req.Key, req.Value)
 		var status int
 		if err != nil {
 			resp.Message = err.Error()
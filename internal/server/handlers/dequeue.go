@@ -2,19 +2,25 @@ package handlers
 
 import (
 	"context"
+	"github.com/morzik45/go-queue/internal/auth"
 	"github.com/morzik45/go-queue/internal/db"
 	"github.com/morzik45/go-queue/internal/logs"
 	"github.com/spf13/viper"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
 type DequeueRequest struct {
 	ApiKey     string   `json:"api_key"`
+	Namespace  string   `json:"namespace,omitempty"`
 	QueueTypes []string `json:"queue_types"`
 	Priority   int      `json:"priority,omitempty"`
 	Timeout    int      `json:"timeout"`
+	Lease      int      `json:"lease,omitempty"` // секунды на обработку, по умолчанию из настроек очереди
+	Scheduling string   `json:"scheduling,omitempty"`
 }
 
 func (dr DequeueRequest) Valid(_ context.Context) map[string]string {
@@ -22,6 +28,12 @@ func (dr DequeueRequest) Valid(_ context.Context) map[string]string {
 	if len(dr.QueueTypes) == 0 {
 		problems["queue_types"] = "field queue_types is required"
 	}
+	if dr.Scheduling != "" && !slices.Contains(db.SchedulingStrategies, dr.Scheduling) {
+		problems["scheduling"] = "field scheduling must be one of " + strings.Join(db.SchedulingStrategies, ", ")
+	}
+	if dr.Lease < 0 {
+		problems["lease"] = "field lease must not be negative"
+	}
 
 	return problems
 }
@@ -33,7 +45,7 @@ type DequeueResponse struct {
 	Task     map[string]interface{} `json:"task"`
 }
 
-func Dequeue(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
+func Dequeue(store *db.DB, _ *viper.Viper) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resp := DequeueResponse{}
 		req, problems, err := decodeValid[DequeueRequest](r)
@@ -49,14 +61,10 @@ func Dequeue(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 			return
 		}
 
-		isAuth := checkApiKey(req.ApiKey, cfg)
-		if !isAuth {
-			resp.Message = "invalid api key"
-			if err2 := encode(w, r, http.StatusUnauthorized, resp); err2 != nil {
-				slog.Error("enqueue send response error",
-					slog.Any("error", err2),
-					slog.Any("problems", problems),
-					slog.Any("first_error", err))
+		if store.Waiters.Draining() {
+			resp.Message = "server is shutting down"
+			if err = encode(w, r, http.StatusServiceUnavailable, resp); err != nil {
+				slog.Error("dequeue send response error", slog.Any("error", err))
 			}
 			return
 		}
@@ -66,10 +74,18 @@ func Dequeue(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 		}
 		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.Timeout)*time.Second)
 		defer cancel()
+		namespace := auth.Namespace(ctx)
+		ctx = logs.WithValue(ctx, "namespace", namespace)
 		ctx = logs.WithValue(ctx, "queue_types", req.QueueTypes)
 		ctx = logs.WithValue(ctx, "priority", req.Priority)
 
-		task, err := store.Waiters.Dequeue(ctx, req.QueueTypes, req.Priority)
+		task, err := store.Waiters.Dequeue(ctx, db.DequeueParams{
+			Namespace:  namespace,
+			Types:      req.QueueTypes,
+			Priority:   req.Priority,
+			Lease:      time.Duration(req.Lease) * time.Second,
+			Scheduling: req.Scheduling,
+		})
 		var status int
 		if err != nil {
 			resp.Message = err.Error()
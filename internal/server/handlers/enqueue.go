@@ -2,18 +2,26 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"github.com/morzik45/go-queue/internal/auth"
 	"github.com/morzik45/go-queue/internal/db"
 	"github.com/spf13/viper"
 	"log/slog"
 	"net/http"
+	"time"
 )
 
 type EnqueueRequest struct {
 	ApiKey       string                 `json:"api_key"`
+	Namespace    string                 `json:"namespace,omitempty"`
 	QueueType    string                 `json:"queue_type"`
 	Priority     int                    `json:"priority,omitempty"`
 	Payload      map[string]interface{} `json:"payload"`
 	Reevaluation int                    `json:"reevaluation,omitempty"`
+	GroupKey     string                 `json:"group_key,omitempty"`
+	ExpiresAt    *time.Time             `json:"expires_at,omitempty"`
+	TTL          int                    `json:"ttl,omitempty"` // секунды, альтернатива expires_at
+	DependsOn    []string               `json:"depends_on,omitempty"`
 }
 
 func (er EnqueueRequest) Valid(_ context.Context) map[string]string {
@@ -24,16 +32,71 @@ func (er EnqueueRequest) Valid(_ context.Context) map[string]string {
 	if len(er.Payload) == 0 {
 		problems["payload"] = "field payload is required"
 	}
+	if er.TTL < 0 {
+		problems["ttl"] = "field ttl must not be negative"
+	}
+	if er.ExpiresAt != nil && er.TTL > 0 {
+		problems["ttl"] = "fields ttl and expires_at are mutually exclusive"
+	}
+	if er.ExpiresAt != nil && !er.ExpiresAt.After(time.Now()) {
+		problems["expires_at"] = "field expires_at must be in the future"
+	}
 	return problems
 }
 
+// expiresAt момент, после которого задачу не нужно выполнять
+func (er EnqueueRequest) expiresAt() time.Time {
+	if er.ExpiresAt != nil {
+		return *er.ExpiresAt
+	}
+	if er.TTL > 0 {
+		return time.Now().Add(time.Duration(er.TTL) * time.Second)
+	}
+	return time.Time{}
+}
+
+func (er EnqueueRequest) params(namespace string) db.EnqueueParams {
+	return db.EnqueueParams{
+		Namespace:    namespace,
+		Type:         er.QueueType,
+		Priority:     er.Priority,
+		Payload:      er.Payload,
+		Reevaluation: er.Reevaluation,
+		GroupKey:     er.GroupKey,
+		ExpiresAt:    er.expiresAt(),
+		DependsOn:    er.DependsOn,
+	}
+}
+
 type EnqueueResponse struct {
 	Success  bool              `json:"success"`
 	TaskID   string            `json:"task_id,omitempty"`
 	Message  string            `json:"message,omitempty"`
 	Problems map[string]string `json:"problems,omitempty"`
+
+	// Заполняются, если клиент дождался завершения задачи (параметр wait)
+	Status string                 `json:"status,omitempty"`
+	Result map[string]interface{} `json:"result,omitempty"`
+}
+
+// waitDuration сколько ждать завершения задачи по параметру wait (например 30s), но не дольше web.max_wait
+func waitDuration(r *http.Request, cfg *viper.Viper) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("parameter wait must be a duration, e.g. 30s")
+	}
+	limit := time.Minute
+	if cfg != nil && cfg.GetDuration("web.max_wait") > 0 {
+		limit = cfg.GetDuration("web.max_wait")
+	}
+	return min(d, limit), nil
 }
 
+// Enqueue добавляет задачу. С параметром wait запрос ждёт завершения задачи и возвращает её результат.
 func Enqueue(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resp := EnqueueResponse{}
@@ -50,28 +113,36 @@ func Enqueue(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 			return
 		}
 
-		isAuth := checkApiKey(req.ApiKey, cfg)
-		if !isAuth {
-			resp.Message = "invalid api key"
-			if err2 := encode(w, r, http.StatusUnauthorized, resp); err2 != nil {
-				slog.Error("enqueue send response error",
-					slog.Any("error", err2),
-					slog.Any("problems", problems),
-					slog.Any("first_error", err))
+		wait, err := waitDuration(r, cfg)
+		if err != nil {
+			resp.Message = err.Error()
+			resp.Problems = map[string]string{"wait": err.Error()}
+			if err = encode(w, r, http.StatusBadRequest, resp); err != nil {
+				slog.Error("enqueue send response error", slog.Any("error", err))
 			}
 			return
 		}
 
 		var id string
-		id, err = store.Enqueue(r.Context(), req.QueueType, req.Priority, req.Payload, req.Reevaluation)
+		id, err = store.Enqueue(r.Context(), req.params(auth.Namespace(r.Context())))
 		var status int
-		if err != nil {
+		if errors.Is(err, db.ErrQuotaExceeded) {
+			resp.Message = err.Error()
+			status = http.StatusTooManyRequests
+		} else if errors.Is(err, db.ErrDependencyNotFound) {
+			resp.Message = err.Error()
+			resp.Problems = map[string]string{"depends_on": err.Error()}
+			status = http.StatusBadRequest
+		} else if err != nil {
 			resp.Message = err.Error()
 			status = http.StatusInternalServerError
 		} else {
 			resp.Success = true
 			resp.TaskID = id
 			status = http.StatusCreated
+			if wait > 0 {
+				status = waitResult(r.Context(), store, id, wait, &resp)
+			}
 		}
 		err = encode(w, r, status, resp)
 		if err != nil {
@@ -79,3 +150,27 @@ func Enqueue(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 		}
 	}
 }
+
+// waitResult ждёт завершения задачи и заполняет ответ её статусом и результатом
+func waitResult(ctx context.Context, store *db.DB, id string, wait time.Duration, resp *EnqueueResponse) int {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	task, err := store.Completions.Wait(ctx, auth.Namespace(ctx), id)
+	switch {
+	case err != nil:
+		slog.ErrorContext(ctx, "wait for task result error", slog.String("id", id), slog.Any("error", err))
+		resp.Message = err.Error()
+		return http.StatusInternalServerError
+	case task == nil:
+		resp.Message = "task is not completed yet"
+		return http.StatusAccepted
+	}
+
+	current := task.Current()
+	resp.Status = current.Status
+	resp.Result = task.Result
+	resp.Success = current.Status == "Processed"
+	resp.Message = current.Message
+	return http.StatusOK
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"github.com/morzik45/go-queue/internal/auth"
 	"github.com/morzik45/go-queue/internal/db"
 	"github.com/spf13/viper"
 	"log/slog"
@@ -10,7 +12,9 @@ import (
 
 type FailRequest struct {
 	ApiKey       string `json:"api_key"`
+	Namespace    string `json:"namespace,omitempty"`
 	ID           string `json:"id"`
+	LeaseID      string `json:"lease_id"`
 	Reevaluation int    `json:"reevaluation,omitempty"`
 	Message      string `json:"message,omitempty"`
 }
@@ -20,6 +24,9 @@ func (fr FailRequest) Valid(_ context.Context) map[string]string {
 	if fr.ID == "" {
 		problems["id"] = "field id is required"
 	}
+	if fr.LeaseID == "" {
+		problems["lease_id"] = "field lease_id is required"
+	}
 	return problems
 }
 
@@ -29,7 +36,7 @@ type FailResponse struct {
 	Problems map[string]string `json:"problems"`
 }
 
-func Fail(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
+func Fail(store *db.DB, _ *viper.Viper) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resp := FailResponse{}
 		req, problems, err := decodeValid[FailRequest](r)
@@ -45,21 +52,18 @@ func Fail(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
 			return
 		}
 
-		isAuth := checkApiKey(req.ApiKey, cfg)
-		if !isAuth {
-			resp.Message = "invalid api key"
-			if err2 := encode(w, r, http.StatusUnauthorized, resp); err2 != nil {
-				slog.Error("enqueue send response error",
-					slog.Any("error", err2),
-					slog.Any("problems", problems),
-					slog.Any("first_error", err))
-			}
-			return
+		ctx := r.Context()
+		if _, err = accessibleTask(ctx, store, req.ID); err == nil {
+			err = store.Failed(ctx, auth.Namespace(ctx), req.ID, req.LeaseID, req.Reevaluation, req.Message)
 		}
-
-		err = store.Failed(r.Context(), req.ID, req.Reevaluation, req.Message)
 		var status int
-		if err != nil {
+		if errors.Is(err, db.ErrTaskNotFound) {
+			resp.Message = err.Error()
+			status = http.StatusNotFound
+		} else if errors.Is(err, db.ErrTaskNotProcessing) {
+			resp.Message = err.Error()
+			status = http.StatusConflict
+		} else if err != nil {
 			resp.Message = err.Error()
 			status = http.StatusInternalServerError
 		} else {
@@ -1,14 +1,85 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"github.com/morzik45/go-queue/internal/db"
+	"github.com/spf13/viper"
+	"log/slog"
 	"net/http"
+	"time"
 )
 
-func Health(_ *db.DB) http.HandlerFunc {
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadyResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Livez сообщает, что процесс жив и обрабатывает запросы. Внешние зависимости не проверяются,
+// чтобы проблемы с базой не приводили к перезапуску подов.
+func Livez() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Ping DB and another checks
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 	}
 }
+
+// Readyz проверяет, что инстанс может обслуживать очередь: база доступна, индексы на месте,
+// и горутина раздачи задач ожидающим обработчикам работает.
+func Readyz(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := 2 * time.Second
+		if cfg.IsSet("health.timeout") {
+			timeout = cfg.GetDuration("health.timeout")
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		resp := ReadyResponse{
+			Status: statusOK,
+			Components: map[string]ComponentStatus{
+				"mongodb": componentStatus(store.Ping(ctx)),
+				"indexes": componentStatus(store.CheckIndexes(ctx)),
+				"watcher": componentStatus(watcherStatus(store)),
+			},
+		}
+
+		status := http.StatusOK
+		for _, c := range resp.Components {
+			if c.Status != statusOK {
+				resp.Status = statusFail
+				status = http.StatusServiceUnavailable
+			}
+		}
+		if status != http.StatusOK {
+			slog.WarnContext(ctx, "readiness check failed", slog.Any("components", resp.Components))
+		}
+		if err := encode(w, r, status, resp); err != nil {
+			slog.Error("readyz send response error", slog.Any("error", err))
+		}
+	}
+}
+
+func watcherStatus(store *db.DB) error {
+	if !store.Waiters.Alive() {
+		return errors.New("queue watcher is not running")
+	}
+	return nil
+}
+
+func componentStatus(err error) ComponentStatus {
+	if err != nil {
+		return ComponentStatus{Status: statusFail, Error: err.Error()}
+	}
+	return ComponentStatus{Status: statusOK}
+}
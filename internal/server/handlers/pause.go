@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+)
+
+type PauseRequest struct {
+	Namespace string `json:"namespace,omitempty"`
+	QueueType string `json:"queue_type"`
+}
+
+func (pr PauseRequest) Valid(_ context.Context) map[string]string {
+	problems := make(map[string]string)
+	if pr.QueueType == "" {
+		problems["queue_type"] = "field queue_type is required"
+	}
+	return problems
+}
+
+type PauseResponse struct {
+	Success  bool              `json:"success"`
+	Message  string            `json:"message,omitempty"`
+	Problems map[string]string `json:"problems,omitempty"`
+}
+
+// Pause останавливает выдачу задач типа очереди на всех инстансах
+func Pause(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return setPaused(store.Pause)
+}
+
+// Resume возобновляет выдачу задач типа очереди
+func Resume(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return setPaused(store.Resume)
+}
+
+func setPaused(apply func(ctx context.Context, namespace, qType string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := PauseResponse{}
+		req, problems, err := decodeValid[PauseRequest](r)
+		if err != nil {
+			resp.Problems = problems
+			resp.Message = err.Error()
+			if err2 := encode(w, r, http.StatusBadRequest, resp); err2 != nil {
+				slog.Error("pause send response error",
+					slog.Any("error", err2),
+					slog.Any("problems", problems),
+					slog.Any("first_error", err))
+			}
+			return
+		}
+
+		err = apply(r.Context(), auth.Namespace(r.Context()), req.QueueType)
+		var status int
+		if err != nil {
+			resp.Message = err.Error()
+			status = http.StatusInternalServerError
+		} else {
+			resp.Success = true
+			status = http.StatusOK
+		}
+		if err = encode(w, r, status, resp); err != nil {
+			slog.Error("pause send response error", slog.Any("error", err))
+		}
+	}
+}
+
+type PausedResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message,omitempty"`
+	Queues  []db.QueueState `json:"queues"`
+}
+
+// Paused возвращает приостановленные типы очередей пространства имён
+func Paused(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := PausedResponse{}
+		queues, err := store.PausedQueues(r.Context(), auth.Namespace(r.Context()))
+		var status int
+		if err != nil {
+			resp.Message = err.Error()
+			status = http.StatusInternalServerError
+		} else {
+			resp.Success = true
+			resp.Queues = queues
+			status = http.StatusOK
+		}
+		if err = encode(w, r, status, resp); err != nil {
+			slog.Error("paused send response error", slog.Any("error", err))
+		}
+	}
+}
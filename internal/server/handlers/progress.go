@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type ProgressRequest struct {
+	ApiKey    string  `json:"api_key"`
+	Namespace string  `json:"namespace,omitempty"`
+	ID        string  `json:"id"`
+	LeaseID   string  `json:"lease_id"`
+	Percent   float64 `json:"percent"`
+	Message   string  `json:"message,omitempty"`
+	Extend    int     `json:"extend,omitempty"` // продлить аренду на столько секунд от текущего момента, не больше аренды типа очереди
+}
+
+func (pr ProgressRequest) Valid(_ context.Context) map[string]string {
+	problems := make(map[string]string)
+	if pr.ID == "" {
+		problems["id"] = "field id is required"
+	}
+	if pr.LeaseID == "" {
+		problems["lease_id"] = "field lease_id is required"
+	}
+	if pr.Percent < 0 || pr.Percent > 100 {
+		problems["percent"] = "field percent must be between 0 and 100"
+	}
+	if pr.Extend < 0 {
+		problems["extend"] = "field extend must not be negative"
+	}
+	return problems
+}
+
+type ProgressResponse struct {
+	Success  bool              `json:"success"`
+	Message  string            `json:"message,omitempty"`
+	Problems map[string]string `json:"problems,omitempty"`
+}
+
+// Progress сохраняет ход выполнения задачи, которую обрабатывает клиент
+func Progress(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := ProgressResponse{}
+		req, problems, err := decodeValid[ProgressRequest](r)
+		if err != nil {
+			resp.Problems = problems
+			resp.Message = err.Error()
+			if err2 := encode(w, r, http.StatusBadRequest, resp); err2 != nil {
+				slog.Error("progress send response error",
+					slog.Any("error", err2),
+					slog.Any("problems", problems),
+					slog.Any("first_error", err))
+			}
+			return
+		}
+
+		ctx := r.Context()
+		if _, err = accessibleTask(ctx, store, req.ID); err == nil {
+			err = store.ReportProgress(ctx, auth.Namespace(ctx), req.ID, db.ProgressParams{
+				Percent: req.Percent,
+				Message: req.Message,
+				LeaseID: req.LeaseID,
+				Extend:  time.Duration(req.Extend) * time.Second,
+			})
+		}
+		var status int
+		switch {
+		case errors.Is(err, db.ErrTaskNotFound):
+			resp.Message = err.Error()
+			status = http.StatusNotFound
+		case errors.Is(err, db.ErrTaskNotProcessing):
+			resp.Message = err.Error()
+			status = http.StatusConflict
+		case err != nil:
+			resp.Message = err.Error()
+			status = http.StatusInternalServerError
+		default:
+			resp.Success = true
+			status = http.StatusOK
+		}
+		if err = encode(w, r, status, resp); err != nil {
+			slog.Error("progress send response error", slog.Any("error", err))
+		}
+	}
+}
+
+// TaskProgress отправляет ход выполнения задачи потоком server-sent events: событие progress при каждом
+// обновлении и событие completed с итоговым статусом и результатом, после которого поток закрывается
+func TaskProgress(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		namespace, id := auth.Namespace(ctx), r.PathValue("id")
+
+		task, err := accessibleTask(ctx, store, id)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, db.ErrTaskNotFound) {
+				status = http.StatusNotFound
+			}
+			if err = encode(w, r, status, TaskResponse{Message: err.Error()}); err != nil {
+				slog.ErrorContext(ctx, "task progress send response error", slog.Any("error", err))
+			}
+			return
+		}
+
+		changes, unsubscribe, err := store.Completions.Subscribe(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+
+		// Обновления с других инстансов приходят только через базу, поэтому дополнительно опрашиваем её
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		var last time.Time
+		for {
+			if task.Progress != nil && !task.Progress.UpdatedAt.Equal(last) {
+				last = task.Progress.UpdatedAt
+				if err = writeEvent(w, "progress", task.Progress); err != nil {
+					return
+				}
+			}
+			if current := task.Current(); db.IsTerminal(current.Status) {
+				_ = writeEvent(w, "completed", EnqueueResponse{
+					Success: current.Status == "Processed",
+					TaskID:  id,
+					Message: current.Message,
+					Status:  current.Status,
+					Result:  task.Result,
+				})
+				_ = rc.Flush()
+				return
+			}
+			if err = rc.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changes:
+			case <-ticker.C:
+				if store.Waiters.Draining() {
+					return
+				}
+			}
+
+			if task, err = store.Task(ctx, namespace, id); err != nil {
+				slog.ErrorContext(ctx, "task progress lookup error", slog.Any("error", err))
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
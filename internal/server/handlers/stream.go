@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/morzik45/go-queue/internal/logs"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStreamCredit    = 10
+	defaultStreamMaxCredit = 100
+	// streamKeepAlive как часто в простаивающий поток пишется комментарий, чтобы прокси не закрыли соединение
+	streamKeepAlive = 15 * time.Second
+	// streamCheckInterval как часто проверяется, какие выданные в поток задачи уже подтверждены на других инстансах
+	streamCheckInterval = time.Second
+)
+
+// QueryTypes типы очередей из параметров queue_types (через запятую или несколько раз)
+func QueryTypes(r *http.Request) []string {
+	var types []string
+	for _, v := range r.URL.Query()["queue_types"] {
+		for _, qType := range strings.Split(v, ",") {
+			if qType = strings.TrimSpace(qType); qType != "" && !slices.Contains(types, qType) {
+				types = append(types, qType)
+			}
+		}
+	}
+	return types
+}
+
+// streamParams разбирает параметры потока: queue_types, priority, lease (секунды), scheduling и credit -
+// сколько задач клиент может держать неподтверждёнными
+func streamParams(r *http.Request, cfg *viper.Viper) (db.DequeueParams, int, map[string]string) {
+	problems := make(map[string]string)
+	q := r.URL.Query()
+	intParam := func(name string, def int) int {
+		v := q.Get(name)
+		if v == "" {
+			return def
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			problems[name] = fmt.Sprintf("parameter %s must be a non-negative integer", name)
+		}
+		return n
+	}
+
+	p := db.DequeueParams{
+		Namespace:  auth.Namespace(r.Context()),
+		Types:      QueryTypes(r),
+		Priority:   intParam("priority", 0),
+		Lease:      time.Duration(intParam("lease", 0)) * time.Second,
+		Scheduling: q.Get("scheduling"),
+	}
+	if len(p.Types) == 0 {
+		problems["queue_types"] = "parameter queue_types is required"
+	}
+	if p.Scheduling != "" && !slices.Contains(db.SchedulingStrategies, p.Scheduling) {
+		problems["scheduling"] = "parameter scheduling must be one of " + strings.Join(db.SchedulingStrategies, ", ")
+	}
+
+	credit, maxCredit := defaultStreamCredit, defaultStreamMaxCredit
+	if cfg != nil && cfg.GetInt("web.stream.credit") > 0 {
+		credit = cfg.GetInt("web.stream.credit")
+	}
+	if cfg != nil && cfg.GetInt("web.stream.max_credit") > 0 {
+		maxCredit = cfg.GetInt("web.stream.max_credit")
+	}
+	if credit = intParam("credit", credit); credit == 0 {
+		problems["credit"] = "parameter credit must be positive"
+	}
+	return p, min(credit, maxCredit), problems
+}
+
+// Stream выдаёт задачи потоком server-sent events (событие task), пока клиент на связи. Неподтверждённых
+// задач в потоке не больше credit: новая задача выдаётся, когда клиент подтвердит (ack, fail) одну из выданных.
+// Задачи, не подтверждённые к моменту отключения клиента, возвращаются в очередь. При остановке сервера поток
+// закрывается, а выданные задачи остаются у клиента, пока он их не подтвердит или не истечёт аренда.
+func Stream(store *db.DB, cfg *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		p, credit, problems := streamParams(r, cfg)
+		if len(problems) > 0 {
+			resp := DequeueResponse{Message: "invalid stream parameters", Problems: problems}
+			if err := encode(w, r, http.StatusBadRequest, resp); err != nil {
+				slog.ErrorContext(ctx, "stream send response error", slog.Any("error", err))
+			}
+			return
+		}
+		if store.Waiters.Draining() {
+			if err := encode(w, r, http.StatusServiceUnavailable, DequeueResponse{Message: "server is shutting down"}); err != nil {
+				slog.ErrorContext(ctx, "stream send response error", slog.Any("error", err))
+			}
+			return
+		}
+
+		ctx = logs.WithValue(ctx, "namespace", p.Namespace)
+		ctx = logs.WithValue(ctx, "queue_types", p.Types)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		s := &stream{
+			store:     store,
+			namespace: p.Namespace,
+			w:         w,
+			rc:        http.NewResponseController(w),
+			inFlight:  make(map[string]string),
+			unsubs:    make(map[string]func()),
+			changes:   make(chan struct{}, 1),
+		}
+		defer s.close(ctx)
+		s.run(ctx, p, credit)
+	}
+}
+
+// stream состояние одного потока: выданные и ещё не подтверждённые задачи
+type stream struct {
+	store     *db.DB
+	namespace string
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+
+	inFlight map[string]string // id задачи -> lease_id
+	unsubs   map[string]func()
+	changes  chan struct{}
+	// broken запись в поток не удалась - выданные задачи клиент мог не получить
+	broken bool
+}
+
+func (s *stream) run(ctx context.Context, p db.DequeueParams, credit int) {
+	if err := s.flush(); err != nil {
+		return
+	}
+	ticker := time.NewTicker(streamCheckInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	for !s.store.Waiters.Draining() {
+		if len(s.inFlight) < credit {
+			waitCtx, cancel := context.WithTimeout(ctx, streamKeepAlive)
+			task, err := s.store.Waiters.Dequeue(waitCtx, p)
+			cancel()
+			if task != nil {
+				// запоминаем до проверки отключения клиента, чтобы close вернула задачу в очередь
+				s.track(task)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "stream dequeue error", slog.Any("error", err))
+				_ = writeEvent(s.w, "error", DequeueResponse{Message: err.Error()})
+				return
+			}
+			if task != nil {
+				if err = s.send(ctx, task); err != nil {
+					return
+				}
+				lastWrite = time.Now()
+				continue
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.changes:
+			case <-ticker.C:
+			}
+		}
+
+		if err := s.refresh(ctx); err != nil {
+			slog.ErrorContext(ctx, "stream lease check error", slog.Any("error", err))
+		}
+		if time.Since(lastWrite) >= streamKeepAlive {
+			if _, err := fmt.Fprint(s.w, ": keepalive\n\n"); err != nil || s.flush() != nil {
+				s.broken = true
+				return
+			}
+			lastWrite = time.Now()
+		}
+	}
+}
+
+// track начинает следить за подтверждением выданной задачи
+func (s *stream) track(task map[string]interface{}) {
+	id, _ := task["id"].(string)
+	leaseID, _ := task["lease_id"].(string)
+	s.inFlight[id] = leaseID
+	if unsub, err := s.store.Completions.SubscribeChan(id, s.changes); err == nil {
+		s.unsubs[id] = unsub
+	}
+}
+
+// send отправляет задачу клиенту
+func (s *stream) send(ctx context.Context, task map[string]interface{}) error {
+	if err := writeEvent(s.w, "task", task); err != nil {
+		s.broken = true
+		return err
+	}
+	if err := s.flush(); err != nil {
+		s.broken = true
+		return err
+	}
+	slog.DebugContext(ctx, "task sent to stream", slog.Any("id", task["id"]))
+	return nil
+}
+
+// refresh освобождает кредит задач, которые уже подтверждены или вернулись в очередь
+func (s *stream) refresh(ctx context.Context) error {
+	if len(s.inFlight) == 0 {
+		return nil
+	}
+	held, err := s.store.HeldLeases(ctx, s.namespace, s.inFlight)
+	if err != nil {
+		return err
+	}
+	for id := range s.inFlight {
+		if !held[id] {
+			s.forget(id)
+		}
+	}
+	return nil
+}
+
+func (s *stream) forget(id string) {
+	delete(s.inFlight, id)
+	if unsub, ok := s.unsubs[id]; ok {
+		unsub()
+		delete(s.unsubs, id)
+	}
+}
+
+func (s *stream) flush() error {
+	return s.rc.Flush()
+}
+
+// close возвращает в очередь задачи, которые клиент так и не подтвердил, если он отключился или их не удалось
+// отправить. Если поток закрывает сервер (остановка, ошибка выдачи), клиент всё ещё может выполнить задачи и
+// подтвердить их, поэтому они остаются у него до истечения аренды.
+func (s *stream) close(ctx context.Context) {
+	requeue := ctx.Err() != nil || s.broken
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	for id, leaseID := range s.inFlight {
+		if !requeue {
+			s.forget(id)
+			continue
+		}
+		err := s.store.Release(ctx, id, leaseID)
+		if err != nil && !errors.Is(err, db.ErrTaskNotProcessing) {
+			slog.ErrorContext(ctx, "failed to requeue unacked stream task", slog.String("id", id), slog.Any("error", err))
+		}
+		s.forget(id)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/db"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+)
+
+type TaskResponse struct {
+	Success bool     `json:"success"`
+	Message string   `json:"message,omitempty"`
+	Task    *db.Task `json:"task,omitempty"`
+}
+
+// Task возвращает задачу по идентификатору, в том числе уже перенесённую в архив
+func Task(store *db.DB, _ *viper.Viper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := TaskResponse{}
+		ctx := r.Context()
+
+		task, err := accessibleTask(ctx, store, r.PathValue("id"))
+
+		var status int
+		switch {
+		case errors.Is(err, db.ErrTaskNotFound):
+			resp.Message = err.Error()
+			status = http.StatusNotFound
+		case err != nil:
+			resp.Message = err.Error()
+			status = http.StatusInternalServerError
+			slog.ErrorContext(ctx, "task lookup error", slog.Any("error", err))
+		default:
+			resp.Success = true
+			resp.Task = task
+			status = http.StatusOK
+		}
+		if err = encode(w, r, status, resp); err != nil {
+			slog.ErrorContext(ctx, "task send response error", slog.Any("error", err))
+		}
+	}
+}
+
+// accessibleTask возвращает задачу, если у клиента есть доступ к её очереди.
+// Задачи чужих очередей не показываем, как будто их нет.
+func accessibleTask(ctx context.Context, store *db.DB, id string) (*db.Task, error) {
+	task, err := store.Task(ctx, auth.Namespace(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	if identity, ok := auth.FromContext(ctx); ok && !identity.CanAccessQueue(task.Type) {
+		return nil, db.ErrTaskNotFound
+	}
+	return task, nil
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/spf13/viper"
 	"net/http"
 )
 
@@ -43,11 +42,3 @@ func decodeValid[T Validator](r *http.Request) (T, map[string]string, error) {
 	}
 	return v, nil, nil
 }
-
-func checkApiKey(apiKey string, cfg *viper.Viper) bool {
-	// TODO: временная реализация, сделать нормальную авторизацию
-	if apiKey == "" || cfg.GetString("api_key") == "" {
-		return false
-	}
-	return apiKey == cfg.GetString("api_key")
-}
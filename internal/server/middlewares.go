@@ -1,11 +1,197 @@
 package server
 
 import (
-	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/metrics"
+	"github.com/spf13/viper"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func initMiddlewares(ctx context.Context, handler http.Handler) http.Handler {
+// metricsMiddleware собирает время обработки запросов по шаблонам маршрутов chi
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
 
-	return handler
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.HTTPDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// traceMiddleware переименовывает серверный спан otelhttp по шаблону маршрута chi,
+// который становится известен только после маршрутизации
+func traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil || rctx.RoutePattern() == "" {
+			return
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + rctx.RoutePattern())
+		span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+	})
+}
+
+type limitConfig struct {
+	Rate  float64 `mapstructure:"rate"` // запросов в секунду
+	Burst int     `mapstructure:"burst"`
+}
+
+// burst размер корзины, по умолчанию - число запросов за секунду
+func (lc limitConfig) burst() int {
+	if lc.Burst > 0 {
+		return lc.Burst
+	}
+	return int(math.Ceil(lc.Rate))
+}
+
+type operationLimits map[string]limitConfig // операция (enqueue, dequeue) -> лимит
+
+type rateLimitsConfig struct {
+	Default    operationLimits            `mapstructure:"default"`
+	Identities map[string]operationLimits `mapstructure:"identities"`
+	Queues     map[string]operationLimits `mapstructure:"queues"`
+}
+
+// rateLimiter ограничивает частоту запросов корзинами токенов: отдельная корзина на каждого клиента
+// (rate_limits.identities, иначе rate_limits.default) и общая на тип очереди (rate_limits.queues).
+// Запрос проходит, только если токен есть во всех подходящих корзинах.
+type rateLimiter struct {
+	mu       sync.Mutex
+	cfg      rateLimitsConfig
+	limiters map[string]*rate.Limiter
+}
+
+func newRateLimiter(cfg *viper.Viper) *rateLimiter {
+	l := &rateLimiter{limiters: make(map[string]*rate.Limiter)}
+	l.Reload(cfg)
+	return l
+}
+
+// Reload применяет новые лимиты. Накопленные токены существующих корзин сохраняются.
+func (l *rateLimiter) Reload(cfg *viper.Viper) {
+	var c rateLimitsConfig
+	if err := cfg.UnmarshalKey("rate_limits", &c); err != nil {
+		slog.Error("failed to read rate limits from config", slog.Any("error", err))
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = c
+	for key, limiter := range l.limiters {
+		lc, ok := l.configFor(key)
+		if !ok {
+			delete(l.limiters, key)
+			continue
+		}
+		limiter.SetLimit(rate.Limit(lc.Rate))
+		limiter.SetBurst(lc.burst())
+	}
+}
+
+// configFor возвращает лимит для ключа корзины вида "identity/<op>/<name>" или "queue/<op>/<type>"
+func (l *rateLimiter) configFor(key string) (limitConfig, bool) {
+	kind, op, name := splitLimiterKey(key)
+	// viper приводит ключи конфига к нижнему регистру
+	name = strings.ToLower(name)
+	var lc limitConfig
+	var ok bool
+	switch kind {
+	case "identity":
+		if lc, ok = l.cfg.Identities[name][op]; !ok {
+			lc, ok = l.cfg.Default[op]
+		}
+	case "queue":
+		lc, ok = l.cfg.Queues[name][op]
+	}
+	return lc, ok && lc.Rate > 0
+}
+
+func splitLimiterKey(key string) (kind, op, name string) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 {
+		return "", "", ""
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+func (l *rateLimiter) limiter(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limiter, ok := l.limiters[key]; ok {
+		return limiter
+	}
+	lc, ok := l.configFor(key)
+	if !ok {
+		return nil
+	}
+	limiter := rate.NewLimiter(rate.Limit(lc.Rate), lc.burst())
+	l.limiters[key] = limiter
+	return limiter
+}
+
+// limit ограничивает частоту операции op. Отвечает 429 с Retry-After, если токенов нет.
+func (l *rateLimiter) limit(op string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keys := make([]string, 0, 2)
+			if identity, ok := auth.FromContext(r.Context()); ok {
+				keys = append(keys, "identity/"+op+"/"+identity.Name)
+			}
+			for _, qType := range targetFromContext(r.Context()).queueTypes() {
+				keys = append(keys, "queue/"+op+"/"+qType)
+			}
+
+			now := time.Now()
+			var (
+				reservations []*rate.Reservation
+				wait         time.Duration
+			)
+			for _, key := range keys {
+				limiter := l.limiter(key)
+				if limiter == nil {
+					continue
+				}
+				res := limiter.ReserveN(now, 1)
+				if !res.OK() {
+					wait = time.Second
+					continue
+				}
+				reservations = append(reservations, res)
+				wait = max(wait, res.DelayFrom(now))
+			}
+
+			if wait > 0 {
+				for _, res := range reservations {
+					res.CancelAt(now)
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
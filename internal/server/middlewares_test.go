@@ -0,0 +1,147 @@
+package server
+
+import (
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+	"strings"
+	"testing"
+)
+
+func limitsFrom(t *testing.T, yaml string) *viper.Viper {
+	t.Helper()
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+const limitsConfig = `
+rate_limits:
+  default:
+    enqueue:
+      rate: 10
+  identities:
+    Billing-Worker:
+      enqueue:
+        rate: 100
+        burst: 20
+      dequeue:
+        rate: 0
+  queues:
+    Emails:
+      dequeue:
+        rate: 2.5
+`
+
+func TestSplitLimiterKey(t *testing.T) {
+	tests := []struct {
+		key            string
+		kind, op, name string
+	}{
+		{key: "identity/enqueue/worker", kind: "identity", op: "enqueue", name: "worker"},
+		{key: "queue/dequeue/reports/daily", kind: "queue", op: "dequeue", name: "reports/daily"},
+		{key: "identity/enqueue/", kind: "identity", op: "enqueue", name: ""},
+		{key: "identity/enqueue"},
+		{key: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			kind, op, name := splitLimiterKey(tt.key)
+			if kind != tt.kind || op != tt.op || name != tt.name {
+				t.Errorf("splitLimiterKey(%q) = %q, %q, %q, want %q, %q, %q", tt.key, kind, op, name, tt.kind, tt.op, tt.name)
+			}
+		})
+	}
+}
+
+func TestRateLimiterConfigFor(t *testing.T) {
+	l := newRateLimiter(limitsFrom(t, limitsConfig))
+	tests := []struct {
+		name   string
+		key    string
+		want   limitConfig
+		wantOK bool
+	}{
+		{name: "identity override", key: "identity/enqueue/Billing-Worker", want: limitConfig{Rate: 100, Burst: 20}, wantOK: true},
+		{name: "identity name is case insensitive", key: "identity/enqueue/billing-worker", want: limitConfig{Rate: 100, Burst: 20}, wantOK: true},
+		{name: "identity falls back to default", key: "identity/enqueue/other", want: limitConfig{Rate: 10}, wantOK: true},
+		{name: "zero rate disables limit", key: "identity/dequeue/Billing-Worker"},
+		{name: "no default for operation", key: "identity/dequeue/other"},
+		{name: "queue limit", key: "queue/dequeue/emails", want: limitConfig{Rate: 2.5}, wantOK: true},
+		{name: "queue has no default", key: "queue/enqueue/emails"},
+		{name: "unknown kind", key: "tenant/enqueue/acme"},
+		{name: "malformed key", key: "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := l.configFor(tt.key)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("configFor(%q) = %+v, %v, want %+v, %v", tt.key, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRateLimiterReload(t *testing.T) {
+	l := newRateLimiter(limitsFrom(t, limitsConfig))
+	identity := l.limiter("identity/enqueue/other")
+	queue := l.limiter("queue/dequeue/Emails")
+	if identity == nil || queue == nil {
+		t.Fatal("expected limiters for configured keys")
+	}
+	if got := queue.Burst(); got != 3 {
+		t.Errorf("default burst = %d, want 3", got)
+	}
+	if l.limiter("queue/enqueue/emails") != nil {
+		t.Error("expected no limiter for unconfigured key")
+	}
+
+	l.Reload(limitsFrom(t, `
+rate_limits:
+  default:
+    enqueue:
+      rate: 5
+      burst: 50
+`))
+
+	tests := []struct {
+		name      string
+		key       string
+		same      *rate.Limiter
+		wantRate  rate.Limit
+		wantBurst int
+		removed   bool
+	}{
+		{name: "existing limiter updated in place", key: "identity/enqueue/other", same: identity, wantRate: 5, wantBurst: 50},
+		{name: "removed limit", key: "queue/dequeue/Emails", removed: true},
+		{name: "new key uses new config", key: "identity/enqueue/fresh", wantRate: 5, wantBurst: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := l.limiter(tt.key)
+			if tt.removed {
+				if limiter != nil {
+					t.Errorf("limiter(%q) = %v, want nil", tt.key, limiter)
+				}
+				return
+			}
+			if limiter == nil {
+				t.Fatalf("limiter(%q) = nil", tt.key)
+			}
+			if tt.same != nil && limiter != tt.same {
+				t.Error("limiter was recreated, accumulated tokens are lost")
+			}
+			if limiter.Limit() != tt.wantRate || limiter.Burst() != tt.wantBurst {
+				t.Errorf("limiter(%q) = %v/%d, want %v/%d", tt.key, limiter.Limit(), limiter.Burst(), tt.wantRate, tt.wantBurst)
+			}
+		})
+	}
+
+	// без burst корзина вмещает запросы за секунду, а не блокирует всё
+	l.Reload(limitsFrom(t, limitsConfig))
+	if got := l.limiter("identity/enqueue/other").Burst(); got != 10 {
+		t.Errorf("burst after reload without burst = %d, want 10", got)
+	}
+}
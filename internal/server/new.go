@@ -2,23 +2,72 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/morzik45/go-queue/internal/auth"
+	"github.com/morzik45/go-queue/internal/configs"
 	"github.com/morzik45/go-queue/internal/db"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"net/http"
 )
 
-func NewServer(ctx context.Context, config *viper.Viper, store *db.DB) http.Handler {
+func NewServer(ctx context.Context, config *viper.Viper, store *db.DB) (http.Handler, error) {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
+	r.Use(metricsMiddleware)
+	r.Use(traceMiddleware)
+
+	authn, err := newAuthenticator(config, store)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := newRateLimiter(config)
+	configs.OnChange(limiter.Reload)
 
 	addRoutes(
 		ctx,
 		r,
 		config,
 		store,
+		authn,
+		limiter,
 	)
 
-	return r
+	return otelhttp.NewHandler(r, "http.server"), nil
+}
+
+// newAuthenticator собирает аутентификаторы согласно auth.mode: api_key (по умолчанию), jwt, mtls или any.
+// Клиентские сертификаты (auth.mtls) проверяются при любом режиме.
+func newAuthenticator(config *viper.Viper, store *db.DB) (auth.Authenticator, error) {
+	mode := "api_key"
+	if config.IsSet("auth.mode") {
+		mode = config.GetString("auth.mode")
+	}
+	switch mode {
+	case "api_key", "jwt", "mtls", "any":
+	default:
+		return nil, fmt.Errorf("unknown auth mode: %s", mode)
+	}
+
+	certs := auth.NewCertificates(config)
+	configs.OnChange(certs.Reload)
+	chain := auth.Chain{certs}
+
+	if mode == "jwt" || mode == "any" {
+		jwtAuth, err := auth.NewJWT(config.Sub("auth.jwt"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure jwt auth: %w", err)
+		}
+		configs.OnChange(func(v *viper.Viper) { jwtAuth.Reload(v.Sub("auth.jwt")) })
+		chain = append(chain, jwtAuth)
+	}
+	if mode == "api_key" || mode == "any" {
+		apiKeys := auth.NewAPIKeys(config, store)
+		configs.OnChange(apiKeys.Reload)
+		chain = append(chain, apiKeys)
+	}
+	return chain, nil
 }
@@ -3,20 +3,41 @@ package server
 import (
 	"context"
 	"github.com/go-chi/chi/v5"
+	"github.com/morzik45/go-queue/internal/auth"
 	"github.com/morzik45/go-queue/internal/db"
 	"github.com/morzik45/go-queue/internal/server/handlers"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 )
 
-func addRoutes(_ context.Context, mux *chi.Mux, cfg *viper.Viper, store *db.DB) {
+func addRoutes(_ context.Context, mux *chi.Mux, cfg *viper.Viper, store *db.DB, authn auth.Authenticator, limiter *rateLimiter) {
 	mux.Route("/api/v1", func(r chi.Router) {
-		r.Post("/enqueue", handlers.Enqueue(store, cfg))
-		r.Post("/dequeue", handlers.Dequeue(store, cfg))
-		r.Post("/count", handlers.Count(store, cfg))
-		r.Post("/ack", handlers.Ack(store, cfg))
-		r.Post("/fail", handlers.Fail(store, cfg))
+		r.Use(peekTarget(cfg), authenticate(authn))
+
+		r.With(authorize(auth.ScopeEnqueue), limiter.limit("enqueue")).Post("/enqueue", handlers.Enqueue(store, cfg))
+		r.With(authorize(auth.ScopeDequeue), limiter.limit("dequeue")).Post("/dequeue", handlers.Dequeue(store, cfg))
+		r.With(authorize(auth.ScopeDequeue), limiter.limit("dequeue")).Get("/stream", handlers.Stream(store, cfg))
+		r.With(authorize(auth.ScopeEnqueue, auth.ScopeDequeue)).Post("/count", handlers.Count(store, cfg))
+		r.With(authorize(auth.ScopeAck)).Post("/ack", handlers.Ack(store, cfg))
+		r.With(authorize(auth.ScopeAck)).Post("/fail", handlers.Fail(store, cfg))
+		r.With(authorize(auth.ScopeAck)).Post("/progress", handlers.Progress(store, cfg))
+		r.With(authorize(auth.ScopeEnqueue, auth.ScopeDequeue, auth.ScopeAck)).Get("/tasks/{id}", handlers.Task(store, cfg))
+		r.With(authorize(auth.ScopeEnqueue, auth.ScopeDequeue, auth.ScopeAck)).Get("/tasks/{id}/progress", handlers.TaskProgress(store, cfg))
+		r.With(authorize(auth.ScopeEnqueue), limiter.limit("enqueue")).Post("/batches", handlers.CreateBatch(store, cfg))
+		r.With(authorize(auth.ScopeEnqueue, auth.ScopeDequeue, auth.ScopeAck)).Get("/batches/{id}", handlers.Batch(store, cfg))
+		r.With(authorize(auth.ScopeEnqueue)).Post("/batches/{id}/cancel", handlers.CancelBatch(store, cfg))
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(authorize(auth.ScopeAdmin))
+			r.Post("/pause", handlers.Pause(store, cfg))
+			r.Post("/resume", handlers.Resume(store, cfg))
+			r.Get("/paused", handlers.Paused(store, cfg))
+		})
 	})
 
-	mux.Handle("/health", handlers.Health(store))
+	mux.Handle("/livez", handlers.Livez())
+	mux.Handle("/readyz", handlers.Readyz(store, cfg))
+	mux.Handle("/health", handlers.Readyz(store, cfg))
+	mux.Handle("/metrics", promhttp.Handler())
 	mux.Handle("/", mux.NotFoundHandler())
 }
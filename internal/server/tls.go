@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/morzik45/go-queue/internal/configs"
+	"github.com/spf13/viper"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+type tlsState struct {
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+	clientAuth tls.ClientAuthType
+}
+
+// tlsReloader держит текущие сертификат и CA клиентов и перечитывает их при изменении конфигурации или самих файлов
+type tlsReloader struct {
+	state atomic.Pointer[tlsState]
+
+	mu      sync.Mutex
+	cfg     *viper.Viper
+	files   map[string]string // путь -> путь после разрешения ссылок
+	watcher *fsnotify.Watcher
+}
+
+// NewTLSConfig создаёт настройки TLS из секции web.tls. Если сертификат не задан, возвращает nil - сервер работает без TLS.
+//
+// Настройки:
+//   - cert_file, key_file: сертификат и ключ сервера
+//   - client_ca_file: CA для проверки клиентских сертификатов (mTLS)
+//   - client_auth: none (по умолчанию), request, verify_if_given или require
+//
+// Настройки и файлы перечитываются при изменении файла конфигурации, сертификата, ключа или CA клиентов.
+func NewTLSConfig(ctx context.Context, cfg *viper.Viper) (*tls.Config, error) {
+	if cfg == nil || cfg.GetString("cert_file") == "" {
+		return nil, nil
+	}
+
+	r := &tlsReloader{files: make(map[string]string)}
+	if err := r.load(cfg); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch tls files: %w", err)
+	}
+	r.watcher = watcher
+	r.watch(cfg)
+	go r.run(ctx)
+	configs.OnChange(func(v *viper.Viper) { r.Reload(v.Sub("web.tls")) })
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.state.Load().cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			state := r.state.Load()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2", "http/1.1"},
+				Certificates: []tls.Certificate{*state.cert},
+				ClientAuth:   state.clientAuth,
+				ClientCAs:    state.clientCAs,
+			}, nil
+		},
+	}, nil
+}
+
+// Reload перечитывает настройки и файлы. При ошибке продолжают использоваться старые.
+// Включить или выключить TLS без перезапуска нельзя.
+func (r *tlsReloader) Reload(cfg *viper.Viper) {
+	if cfg == nil || cfg.GetString("cert_file") == "" {
+		slog.Warn("web.tls.cert_file is not set, keeping previous tls certificates")
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.load(cfg); err != nil {
+		slog.Error("failed to reload tls certificates, keeping previous", slog.Any("error", err))
+		return
+	}
+	r.watch(cfg)
+	slog.Info("tls certificates reloaded")
+}
+
+// watch следит за каталогами файлов сертификата: при замене файла переименованием наблюдение за самим файлом
+// теряется, а за каталогом - нет. Kubernetes обновляет секреты подменой ссылки, поэтому запоминается и то,
+// куда ведут ссылки.
+func (r *tlsReloader) watch(cfg *viper.Viper) {
+	r.cfg = cfg
+	clear(r.files)
+	for _, key := range []string{"cert_file", "key_file", "client_ca_file"} {
+		name := cfg.GetString(key)
+		if name == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(name); err == nil {
+			name = abs
+		}
+		r.files[name], _ = filepath.EvalSymlinks(name)
+		if err := r.watcher.Add(filepath.Dir(name)); err != nil {
+			slog.Warn("failed to watch tls file", slog.String("path", name), slog.Any("error", err))
+		}
+	}
+}
+
+// run перечитывает сертификаты при изменении их файлов, пока не отменён ctx
+func (r *tlsReloader) run(ctx context.Context) {
+	defer func() { _ = r.watcher.Close() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("tls files watch error", slog.Any("error", err))
+		case e, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if e.Op == fsnotify.Chmod || !r.watched(e.Name) {
+				continue
+			}
+			slog.Info("tls file changed", slog.String("path", e.Name))
+			r.mu.Lock()
+			cfg := r.cfg
+			r.mu.Unlock()
+			r.Reload(cfg)
+		}
+	}
+}
+
+// watched изменился ли один из файлов сертификата или то, куда ведёт ссылка на него
+func (r *tlsReloader) watched(name string) bool {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.files[name]; ok {
+		return true
+	}
+	for file, real := range r.files {
+		if current, _ := filepath.EvalSymlinks(file); current != real {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *tlsReloader) load(cfg *viper.Viper) error {
+	certFile, keyFile, caFile := cfg.GetString("cert_file"), cfg.GetString("key_file"), cfg.GetString("client_ca_file")
+
+	var state tlsState
+	switch cfg.GetString("client_auth") {
+	case "", "none":
+		state.clientAuth = tls.NoClientCert
+	case "request":
+		state.clientAuth = tls.RequestClientCert
+	case "verify_if_given":
+		state.clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		state.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown web.tls.client_auth: %s", cfg.GetString("client_auth"))
+	}
+	if state.clientAuth >= tls.VerifyClientCertIfGiven && caFile == "" {
+		return errors.New("web.tls.client_ca_file is required to verify client certificates")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	state.cert = &cert
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client ca: %w", err)
+		}
+		state.clientCAs = x509.NewCertPool()
+		if !state.clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	r.state.Store(&state)
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/spf13/viper"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert записывает самоподписанный сертификат с номером serial и его ключ, заменяя файлы переименованием
+func writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replace := func(name, blockType string, data []byte) {
+		tmp := name + ".tmp"
+		if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace(keyFile, "EC PRIVATE KEY", keyDER)
+	replace(certFile, "CERTIFICATE", der)
+}
+
+func serialOf(t *testing.T, cfg *tls.Config) int64 {
+	t.Helper()
+	cert, err := cfg.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, 1)
+
+	tests := []struct {
+		name    string
+		values  map[string]string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "no certificate", values: map[string]string{}, wantNil: true},
+		{name: "certificate", values: map[string]string{"cert_file": certFile, "key_file": keyFile}},
+		{name: "verify with ca", values: map[string]string{"cert_file": certFile, "key_file": keyFile, "client_auth": "require", "client_ca_file": certFile}},
+		{name: "verify without ca", values: map[string]string{"cert_file": certFile, "key_file": keyFile, "client_auth": "require"}, wantErr: true},
+		{name: "unknown client_auth", values: map[string]string{"cert_file": certFile, "key_file": keyFile, "client_auth": "always"}, wantErr: true},
+		{name: "missing key", values: map[string]string{"cert_file": certFile, "key_file": filepath.Join(dir, "missing.key")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cfg := viper.New()
+			for k, v := range tt.values {
+				cfg.Set(k, v)
+			}
+			got, err := NewTLSConfig(ctx, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got == nil) != tt.wantNil {
+				t.Errorf("NewTLSConfig() = %v, want nil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestTLSReloadOnFileChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, 1)
+
+	cfg := viper.New()
+	cfg.Set("cert_file", certFile)
+	cfg.Set("key_file", keyFile)
+	tlsConfig, err := NewTLSConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serialOf(t, tlsConfig); got != 1 {
+		t.Fatalf("serial = %d, want 1", got)
+	}
+
+	writeCert(t, certFile, keyFile, 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for serialOf(t, tlsConfig) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not reloaded after the file changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
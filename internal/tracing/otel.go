@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const defaultServiceName = "go-queue"
+
+// Init настраивает глобальный TracerProvider и пропагатор W3C Trace Context.
+// Возвращает функцию, которую нужно вызвать при завершении работы, чтобы отправить оставшиеся спаны.
+//
+// Поддерживаемые экспортёры (tracing.exporter):
+//   - none (по умолчанию) - спаны не экспортируются, но контекст трассировки передаётся дальше
+//   - stdout - спаны пишутся в stdout или в файл tracing.file
+//   - otlp - спаны отправляются по OTLP/HTTP на tracing.endpoint
+func Init(ctx context.Context, cfg *viper.Viper) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var (
+		exporterName = "none"
+		serviceName  = defaultServiceName
+		ratio        = 1.0
+	)
+	if cfg != nil {
+		if cfg.IsSet("exporter") {
+			exporterName = cfg.GetString("exporter")
+		}
+		if cfg.IsSet("service_name") {
+			serviceName = cfg.GetString("service_name")
+		}
+		if cfg.IsSet("sample_ratio") {
+			ratio = cfg.GetFloat64("sample_ratio")
+		}
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		closer   io.Closer
+		err      error
+	)
+	switch exporterName {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		writer := io.Writer(os.Stdout)
+		if path := cfg.GetString("file"); path != "" {
+			var f *os.File
+			f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open trace file: %w", err)
+			}
+			writer, closer = f, f
+		}
+		opts := []stdouttrace.Option{stdouttrace.WithWriter(writer)}
+		if cfg.GetBool("pretty") {
+			opts = append(opts, stdouttrace.WithPrettyPrint())
+		}
+		exporter, err = stdouttrace.New(opts...)
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.GetString("endpoint"))}
+		if cfg.GetBool("insecure") {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporterName, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	slog.Info("tracing enabled", slog.String("exporter", exporterName))
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// SignatureHeader заголовок с подписью тела запроса
+	SignatureHeader = "X-Queue-Signature"
+	// TimestampHeader заголовок с моментом отправки запроса (unix секунды), входит в подпись
+	TimestampHeader = "X-Queue-Timestamp"
+
+	signaturePrefix = "sha256="
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Sign подписывает тело запроса: HMAC-SHA256 от "<timestamp>.<body>" в виде "sha256=<hex>"
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature проверяет подпись, полученную в заголовках SignatureHeader и TimestampHeader.
+// Запросы старше tolerance отклоняются, чтобы их нельзя было повторить; 0 - не проверять время.
+func VerifySignature(secret []byte, timestamp, signature string, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && time.Since(time.Unix(ts, 0)).Abs() > tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(Sign(secret, ts, body)), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
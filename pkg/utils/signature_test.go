@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"id":"665f1c2e8a1b2c3d4e5f6a7b"}`)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		secret    []byte
+		timestamp string
+		signature string
+		body      []byte
+		tolerance time.Duration
+		wantErr   bool
+	}{
+		{
+			name:      "valid",
+			timestamp: strconv.FormatInt(now, 10),
+			signature: Sign(secret, now, body),
+			tolerance: 5 * time.Minute,
+		},
+		{
+			name:      "valid within tolerance",
+			timestamp: strconv.FormatInt(now-60, 10),
+			signature: Sign(secret, now-60, body),
+			tolerance: 5 * time.Minute,
+		},
+		{
+			name:      "too old",
+			timestamp: strconv.FormatInt(now-600, 10),
+			signature: Sign(secret, now-600, body),
+			tolerance: 5 * time.Minute,
+			wantErr:   true,
+		},
+		{
+			name:      "from the future",
+			timestamp: strconv.FormatInt(now+600, 10),
+			signature: Sign(secret, now+600, body),
+			tolerance: 5 * time.Minute,
+			wantErr:   true,
+		},
+		{
+			name:      "old without tolerance",
+			timestamp: strconv.FormatInt(now-600, 10),
+			signature: Sign(secret, now-600, body),
+		},
+		{
+			name:      "wrong secret",
+			secret:    []byte("other"),
+			timestamp: strconv.FormatInt(now, 10),
+			signature: Sign(secret, now, body),
+			wantErr:   true,
+		},
+		{
+			name:      "tampered body",
+			timestamp: strconv.FormatInt(now, 10),
+			signature: Sign(secret, now, body),
+			body:      []byte(`{"id":"other"}`),
+			wantErr:   true,
+		},
+		{
+			name:      "timestamp not signed",
+			timestamp: strconv.FormatInt(now+1, 10),
+			signature: Sign(secret, now, body),
+			wantErr:   true,
+		},
+		{
+			name:      "bad timestamp",
+			timestamp: "yesterday",
+			signature: Sign(secret, now, body),
+			wantErr:   true,
+		},
+		{
+			name:      "missing signature",
+			timestamp: strconv.FormatInt(now, 10),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, b := secret, body
+			if tt.secret != nil {
+				s = tt.secret
+			}
+			if tt.body != nil {
+				b = tt.body
+			}
+			err := VerifySignature(s, tt.timestamp, tt.signature, b, tt.tolerance)
+			if tt.wantErr && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("VerifySignature() error = %v, want %v", err, ErrInvalidSignature)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("VerifySignature() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      string
+		want      string
+	}{
+		{
+			name:      "json body",
+			secret:    "secret",
+			timestamp: 1700000000,
+			body:      "{}",
+			want:      "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163",
+		},
+		{
+			name:      "empty body",
+			secret:    "key",
+			timestamp: 1700000000,
+			want:      "sha256=0f1cc1f811f42fd12af9618acf321769899fa521fe07a642f70a61785e130770",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign([]byte(tt.secret), tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("Sign() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}